@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// redacted replaces passwords in configs returned by the admin API.
+const redacted = "REDACTED"
+
+// redactedConfig returns config as a JSON-friendly value using the same keys as the YAML, without any passwords.
+func redactedConfig(config ShovelConfig) interface{} {
+	config.Source.AMQPHost = config.Source.redacted()
+	config.Sinks = append([]ShovelSink(nil), config.Sinks...)
+	for i := range config.Sinks {
+		config.Sinks[i].AMQPHost = config.Sinks[i].redacted()
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return nil
+	}
+	var value interface{}
+	if err := yaml.Unmarshal(out, &value); err != nil {
+		return nil
+	}
+	return jsonValue(value)
+}
+
+func (h AMQPHost) redacted() AMQPHost {
+	if h.Password != "" {
+		h.Password = redacted
+	}
+	h.URL = redactURI(h.URL)
+	urls := make([]string, len(h.URLs))
+	for i, uri := range h.URLs {
+		urls[i] = redactURI(uri)
+	}
+	h.URLs = urls
+	return h
+}
+
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// jsonValue converts the maps produced by decoding YAML into ones encoding/json accepts.
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			m[fmt.Sprint(k)] = jsonValue(v)
+		}
+		return m
+	case []interface{}:
+		for i, v := range value {
+			value[i] = jsonValue(v)
+		}
+	}
+	return value
+}
+
+// adminHandler serves the admin API:
+//
+//	GET  /shovels                                list every shovel
+//	GET  /shovels/NAME                           show a single shovel
+//	POST /shovels/NAME/ACTION                    pause, resume or restart every worker of a shovel
+//	POST /shovels/NAME/workers/INDEX/ACTION      pause, resume or restart a single worker
+//	POST /reload                                 re-read the config files
+//
+// Reloads are requested by sending a reply channel on reloads.
+func adminHandler(manager *Manager, reloads chan<- chan error) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+
+		reply := make(chan error, 1)
+		reloads <- reply
+		if err := <-reply; err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	})
+
+	mux.HandleFunc("/shovels", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, manager.Status())
+	})
+
+	mux.HandleFunc("/shovels/", func(w http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/shovels/"), "/")
+		name := parts[0]
+
+		switch {
+		case len(parts) == 1 && req.Method == "GET":
+			for _, status := range manager.Status() {
+				if status.Name == name {
+					writeJSON(w, http.StatusOK, status)
+					return
+				}
+			}
+			writeError(w, http.StatusNotFound, errUnknownShovel.Error())
+
+		case len(parts) == 2 && req.Method == "POST":
+			control(w, manager, name, 0, parts[1])
+
+		case len(parts) == 4 && parts[1] == "workers" && req.Method == "POST":
+			worker, err := strconv.Atoi(parts[2])
+			if err != nil || worker < 1 {
+				writeError(w, http.StatusNotFound, errUnknownWorker.Error())
+				return
+			}
+			control(w, manager, name, worker, parts[3])
+
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	})
+
+	return mux
+}
+
+func control(w http.ResponseWriter, manager *Manager, name string, worker int, action string) {
+	switch err := manager.Control(name, worker, action); err {
+	case nil:
+		writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	case errUnknownAction:
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeError(w, http.StatusNotFound, err.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// openListener opens a TCP listener, or a Unix socket if addr starts with "unix:".
+// A socket left behind at the path is replaced, but any other file is an error.
+func openListener(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		if info, err := os.Lstat(path); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%s exists and is not a socket", path)
+			}
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
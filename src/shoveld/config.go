@@ -1,110 +1,485 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/streadway/amqp"
 	"gopkg.in/yaml.v2"
 )
 
 var numShovels = 0
 
+// heartbeat is the interval requested for connection heartbeats.
+const heartbeat = 10 * time.Second
+
 // ShovelConfig represents the settings corresponding to a single shovel
+// Sinks may be given instead of Sink to publish to several brokers, either to every
+// sink whose Match accepts a message or, with SinkMode first, only to the first of them.
+// Once parsed, Sinks always holds every sink and Sink is left empty.
+// Mandatory publishes so that a sink returns messages it can't route to any queue,
+// and OnReturn decides what happens to them on the source.
 type ShovelConfig struct {
 	Name        string // friendly name for shovel
 	Concurrency int
 	Source      ShovelSource
-	Sink        ShovelSink
+	Sink        ShovelSink `yaml:",omitempty"`
+	Sinks       []ShovelSink
+	SinkMode    string
+	Reconnect   ShovelReconnect
+	Transforms  []ShovelTransform
+	Filter      *ShovelFilter
+	DeadLetter  *ShovelDeadLetter
+	Mandatory   bool
+	OnReturn    string
 }
 
+// Values of OnReturn, for messages a sink returns because they could not be routed.
+const (
+	returnRequeue    = "requeue"
+	returnDeadLetter = "deadletter"
+	returnDrop       = "drop"
+)
+
+// Values of SinkMode.
+const (
+	sinkModeFanout = "fanout"
+	sinkModeFirst  = "first"
+)
+
 // AMQPHost contains the host details required for an amqp connection
+// PasswordFile and URIFile name files to read the password or a complete
+// connection string from, so credentials can be kept out of the config.
+// URL and URLs take complete connection strings instead of Host, Port, etc.
+// Setting TLS connects with amqps; Port usually needs changing to 5671 too.
+// AuthMechanism is PLAIN to log in with User and Password, or EXTERNAL to
+// authenticate with the TLS client certificate instead.
 type AMQPHost struct {
-	Host     string
-	Port     int
-	User     string
-	Password string
-	VHost    string
+	Host          string
+	Port          int
+	User          string
+	Password      string
+	VHost         string
+	URL           string   `yaml:"uri"`
+	URLs          []string `yaml:"uris"`
+	PasswordFile  string
+	URIFile       string
+	TLS           *AMQPTLS
+	AuthMechanism string
+	uri           string // contents of URIFile
 }
 
-// URI returns an AMQP connection string.
-func (h AMQPHost) URI() string {
-	return fmt.Sprintf("amqp://%s:%s@%s:%d/%s", h.User, h.Password, h.Host, h.Port, url.QueryEscape(h.VHost))
+// URIs returns the AMQP connection strings to try, in order.
+func (h AMQPHost) URIs() []string {
+	var uris []string
+	if h.uri != "" {
+		uris = append(uris, h.uri)
+	}
+	if h.URL != "" {
+		uris = append(uris, h.URL)
+	}
+	uris = append(uris, h.URLs...)
+	if len(uris) > 0 {
+		return uris
+	}
+
+	scheme := "amqp"
+	if h.TLS != nil {
+		scheme = "amqps"
+	}
+	u := url.URL{
+		Scheme: scheme,
+		User:   url.UserPassword(h.User, h.Password),
+		Host:   net.JoinHostPort(h.Host, strconv.Itoa(h.Port)),
+		Path:   "/" + h.VHost}
+	return []string{u.String()}
 }
 
 // ShovelSource represnets the source queue to read from.
-// Exchange is optional and indicates an exchange to which the queue should be bound.
+// Queues may be given instead of Queue and Bindings to consume several queues over
+// one connection, and entries without a Prefetch, Declare, Type or Offset of their own use the source's.
+// Once parsed, Queues always holds every queue and the inline ShovelQueue is left empty.
 type ShovelSource struct {
-	AMQPHost `yaml:",inline"`
-	Queue    string
-	Bindings []ShovelSourceBinding
-	Prefetch int
-	// TODO: Transient bool
+	AMQPHost    `yaml:",inline"`
+	ShovelQueue `yaml:",inline"`
+	Queues      []ShovelQueue
+}
+
+// inheritedQueueKeys are the ShovelQueue keys a source may set alongside Queues, as defaults for its entries.
+var inheritedQueueKeys = map[string]bool{"prefetch": true, "declare": true, "type": true, "offset": true}
+
+// queueNames returns the name of each queue, in order.
+func (s ShovelSource) queueNames() []string {
+	names := make([]string, len(s.Queues))
+	for i, queue := range s.Queues {
+		names[i] = queue.Queue
+	}
+	return names
+}
+
+// ShovelQueue is a queue to consume and the bindings that feed it.
+// Type is optional and declares a classic, quorum or stream queue.
+// Offset is where to start consuming a stream, defaulting to next.
+type ShovelQueue struct {
+	Queue    string                `yaml:",omitempty"`
+	Bindings []ShovelSourceBinding `yaml:",omitempty"`
+	Prefetch int                   `yaml:",omitempty"`
+	Declare  *ShovelDeclare        `yaml:",omitempty"`
+	Type     string                `yaml:",omitempty"`
+	Offset   string                `yaml:",omitempty"`
 }
 
 // ShovelSourceBinding represents a single binding to feed the input queue.
+// Arguments are matched against message headers when Exchange is a headers exchange.
 type ShovelSourceBinding struct {
 	Exchange   string
 	RoutingKey string
+	Arguments  map[string]interface{} `yaml:",omitempty"`
+}
+
+// ShovelSinkBinding binds the sink exchange to another exchange on the sink broker,
+// which then receives the messages published to the sink that match.
+type ShovelSinkBinding struct {
+	Exchange   string
+	RoutingKey string
+	Arguments  map[string]interface{} `yaml:",omitempty"`
 }
 
 // ShovelSink represents the output of the shovel.
 // RoutingKey is optional and overrides a message's routing key if specified.
+// RewriteRoutingKey is optional and rewrites the routing key after that.
+// Match is optional and limits the sink to messages it selects.
+// Queue may be given instead of Exchange to publish straight to a queue through the default
+// exchange. The queue is only declared if Declare is set, while Exchange always is.
+// Bindings are only possible with Exchange.
 type ShovelSink struct {
-	AMQPHost     `yaml:",inline"`
-	Exchange     string
-	RoutingKey   string
-	ExchangeType string
+	AMQPHost          `yaml:",inline"`
+	Exchange          string
+	Queue             string
+	RoutingKey        string
+	ExchangeType      string
+	RewriteRoutingKey *ShovelRoutingKey
+	Match             *ShovelMatch
+	Declare           *ShovelDeclare
+	Bindings          []ShovelSinkBinding
+}
+
+func defaultSink() ShovelSink {
+	return ShovelSink{
+		AMQPHost: AMQPHost{
+			Host:          "localhost",
+			Port:          5672,
+			VHost:         "/",
+			User:          "guest",
+			Password:      "guest",
+			AuthMechanism: "PLAIN"},
+		Exchange:     "", // required
+		RoutingKey:   "",
+		ExchangeType: "topic"}
+}
+
+// UnmarshalYAML fills in defaults, so they also apply to each entry of Sinks.
+func (s *ShovelSink) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ShovelSink
+	sink := plain(defaultSink())
+	if err := unmarshal(&sink); err != nil {
+		return err
+	}
+	*s = ShovelSink(sink)
+	return nil
+}
+
+// ShovelReconnect controls the exponential backoff between reconnect attempts.
+// Jitter is the fraction of each delay that is randomized, between 0 and 1.
+type ShovelReconnect struct {
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	Factor   float64
+	Jitter   float64
+}
+
+// Delay returns how long to wait before the given reconnect attempt, counting from 0.
+func (r ShovelReconnect) Delay(attempt int) time.Duration {
+	delay := float64(r.MinDelay) * math.Pow(r.Factor, float64(attempt))
+	if max := float64(r.MaxDelay); delay > max {
+		delay = max
+	}
+	delay += delay * r.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(delay)
+}
+
+// Dial opens a connection to the first reachable of the host's URIs, using TLS if configured.
+func (h AMQPHost) Dial() (*amqp.Connection, error) {
+	config := amqp.Config{Heartbeat: heartbeat}
+	if h.TLS != nil {
+		var err error
+		if config.TLSClientConfig, err = h.TLS.Config(); err != nil {
+			return nil, err
+		}
+	}
+	if strings.EqualFold(h.AuthMechanism, externalAuth{}.Mechanism()) {
+		config.SASL = []amqp.Authentication{externalAuth{}}
+	}
+
+	uris := h.URIs()
+	var failures []string
+	for _, uri := range uris {
+		connection, err := amqp.DialConfig(uri, config)
+		if err == nil {
+			return connection, nil
+		}
+		if len(uris) == 1 {
+			return nil, err
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", redactURI(uri), err))
+	}
+	return nil, errors.New(strings.Join(failures, "; "))
+}
+
+// endpoint returns the host and vhost of the first URI, for logging.
+func (h AMQPHost) endpoint() (string, string) {
+	uri, err := amqp.ParseURI(h.URIs()[0])
+	if err != nil {
+		return "", ""
+	}
+	return uri.Host, uri.Vhost
+}
+
+// readFiles loads the password and connection string from PasswordFile and URIFile, if set.
+func (h *AMQPHost) readFiles(prefix string) []FieldError {
+	var problems []FieldError
+
+	if h.PasswordFile != "" {
+		password, err := readSecret(h.PasswordFile)
+		if err != nil {
+			problems = append(problems, FieldError{Field: prefix + ".passwordfile", Message: err.Error()})
+		}
+		h.Password = password
+	}
+
+	if h.URIFile != "" {
+		uri, err := readSecret(h.URIFile)
+		if err != nil {
+			problems = append(problems, FieldError{Field: prefix + ".urifile", Message: err.Error()})
+		}
+		h.uri = uri
+	}
+
+	return problems
 }
 
+// documentSeparator matches the "---" lines between YAML documents in a stream.
+var documentSeparator = regexp.MustCompile(`(?m)^---[ \t]*(#.*)?$`)
+
 // ParseShovel parses a ShovelConfig from a given reader.
-func ParseShovel(reader io.Reader) ShovelConfig {
+// Any problems with the config are returned together as a ConfigError.
+func ParseShovel(reader io.Reader) (ShovelConfig, error) {
 	bytes, err := ioutil.ReadAll(reader)
 	if err != nil {
-		log.Fatal(err)
+		return ShovelConfig{}, err
 	}
 
+	shovel, problems := parseShovel(bytes)
+	if len(problems) > 0 {
+		return shovel, problems
+	}
+	return shovel, nil
+}
+
+// ParseShovels parses every ShovelConfig from a given reader.
+// The input may hold several YAML documents separated by "---",
+// each of which is either a single shovel or a list of shovels.
+// Problems with any of the shovels are returned together as a ConfigError.
+func ParseShovels(reader io.Reader) ([]ShovelConfig, error) {
+	bytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// syntax errors are numbered from the start of each document, so they are offset by the lines before it
+	text := string(bytes)
+	offsets := []int{0}
+	for _, separator := range documentSeparator.FindAllStringIndex(text, -1) {
+		offsets = append(offsets, strings.Count(text[:separator[1]], "\n"))
+	}
+
+	var shovels []ShovelConfig
+	var problems ConfigError
+	for i, document := range documentSeparator.Split(text, -1) {
+		var value interface{}
+		if err := yaml.Unmarshal([]byte(document), &value); err != nil {
+			problems = append(problems, FieldError{Message: shiftLines(err.Error(), offsets[i])})
+			continue
+		}
+
+		switch value := value.(type) {
+		case nil:
+			// empty document
+		case []interface{}:
+			for _, item := range value {
+				out, err := yaml.Marshal(item)
+				if err != nil {
+					problems = append(problems, FieldError{Message: err.Error()})
+					continue
+				}
+				shovel, errs := parseShovel(out)
+				shovels = append(shovels, shovel)
+				problems = append(problems, errs...)
+			}
+		default:
+			shovel, errs := parseShovel([]byte(document))
+			shovels = append(shovels, shovel)
+			problems = append(problems, errs...)
+		}
+	}
+
+	if len(problems) > 0 {
+		return shovels, problems
+	}
+	return shovels, nil
+}
+
+func parseShovel(bytes []byte) (ShovelConfig, ConfigError) {
 	shovel := ShovelConfig{
 		Name:        "",
 		Concurrency: 1,
 		Source: ShovelSource{
 			AMQPHost: AMQPHost{
-				Host:     "localhost",
-				Port:     5672,
-				VHost:    "/",
-				User:     "guest",
-				Password: "guest"},
-			Queue:    "", // required
-			Bindings: nil,
-			Prefetch: 100},
-		Sink: ShovelSink{
-			AMQPHost: AMQPHost{
-				Host:     "localhost",
-				Port:     5672,
-				VHost:    "/",
-				User:     "guest",
-				Password: "guest"},
-			Exchange:     "", // required
-			RoutingKey:   "",
-			ExchangeType: "topic"}}
+				Host:          "localhost",
+				Port:          5672,
+				VHost:         "/",
+				User:          "guest",
+				Password:      "guest",
+				AuthMechanism: "PLAIN"},
+			ShovelQueue: ShovelQueue{
+				Queue:    "", // required
+				Bindings: nil,
+				Prefetch: 100}},
+		Sink:     defaultSink(),
+		SinkMode: sinkModeFanout,
+		OnReturn: returnRequeue,
+		Reconnect: ShovelReconnect{
+			MinDelay: time.Second,
+			MaxDelay: 30 * time.Second,
+			Factor:   2,
+			Jitter:   0.2}}
+
+	var problems ConfigError
+
+	var value interface{}
+	if err := yaml.Unmarshal(bytes, &value); err != nil {
+		problems = append(problems, FieldError{Message: err.Error()})
+	}
+	for _, key := range unknownKeys("", value, reflect.TypeOf(shovel)) {
+		problems = append(problems, FieldError{Field: key, Message: "unknown key"})
+	}
+
+	env := envExpander{}
+	value, _ = env.expand("", value, reflect.TypeOf(shovel))
+	problems = append(problems, env.problems...)
+	if env.changed {
+		expanded, err := yaml.Marshal(value)
+		if err != nil {
+			problems = append(problems, FieldError{Message: err.Error()})
+		}
+		bytes = expanded
+	}
 
 	if err := yaml.Unmarshal(bytes, &shovel); err != nil {
-		log.Fatal(err)
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			found := typeErrors("", value, reflect.TypeOf(shovel))
+			if len(found) == 0 {
+				for _, message := range typeErr.Errors {
+					found = append(found, FieldError{Message: shiftLines(message, -1)})
+				}
+			}
+			problems = append(problems, found...)
+		} else if value != nil {
+			problems = append(problems, FieldError{Message: err.Error()})
+		}
 	}
 
 	if shovel.Name == "" {
 		shovel.Name = fmt.Sprintf("shovel%d", numShovels)
 	}
-
-	if shovel.Concurrency < 0 {
-		log.Fatal("negative concurrency not allowed")
-	}
 	if shovel.Concurrency == 0 {
 		shovel.Concurrency = 1
 	}
+	if shovel.DeadLetter != nil && shovel.DeadLetter.MaxAttempts == 0 {
+		shovel.DeadLetter.MaxAttempts = 3
+	}
+
+	problems = append(problems, shovel.Source.readFiles("source")...)
+	if m, ok := value.(map[interface{}]interface{}); ok {
+		if m["sink"] != nil && m["sinks"] != nil {
+			problems = append(problems, FieldError{Field: "sinks", Message: "cannot be combined with sink"})
+		}
+		if source, ok := m["source"].(map[interface{}]interface{}); ok && source["queues"] != nil {
+			var keys []string
+			for key := range yamlFields(reflect.TypeOf(ShovelQueue{})) {
+				if source[key] != nil && !inheritedQueueKeys[key] {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				problems = append(problems, FieldError{Field: "source." + key, Message: "cannot be combined with queues"})
+			}
+		}
+		problems = append(problems, uriConflicts("source", m["source"])...)
+		problems = append(problems, uriConflicts("sink", m["sink"])...)
+		if sinks, ok := m["sinks"].([]interface{}); ok {
+			for i, sink := range sinks {
+				problems = append(problems, uriConflicts(fmt.Sprintf("sinks[%d]", i), sink)...)
+			}
+		}
+	}
+	for i := range shovel.Source.Queues {
+		if shovel.Source.Queues[i].Prefetch == 0 {
+			shovel.Source.Queues[i].Prefetch = shovel.Source.Prefetch
+		}
+		if shovel.Source.Queues[i].Declare == nil {
+			shovel.Source.Queues[i].Declare = shovel.Source.Declare
+		}
+		if shovel.Source.Queues[i].Type == "" {
+			shovel.Source.Queues[i].Type = shovel.Source.Type
+		}
+		if shovel.Source.Queues[i].Offset == "" {
+			shovel.Source.Queues[i].Offset = shovel.Source.Offset
+		}
+	}
+	if len(shovel.Sinks) == 0 {
+		problems = append(problems, shovel.Sink.readFiles("sink")...)
+	}
+	for i := range shovel.Sinks {
+		problems = append(problems, shovel.Sinks[i].readFiles(fmt.Sprintf("sinks[%d]", i))...)
+	}
+	problems = append(problems, shovel.validate()...)
+	for i := range problems {
+		problems[i].Shovel = shovel.Name
+	}
+
+	if len(shovel.Source.Queues) == 0 {
+		shovel.Source.Queues = []ShovelQueue{shovel.Source.ShovelQueue}
+	}
+	shovel.Source.ShovelQueue = ShovelQueue{}
+	if len(shovel.Sinks) == 0 {
+		shovel.Sinks = []ShovelSink{shovel.Sink}
+	}
+	shovel.Sink = ShovelSink{}
 
 	numShovels++
-	return shovel
+	return shovel, problems
 }
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseShovelsTypeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{"single shovel", `
+name: orders
+source:
+  queue: orders
+  prefetch: lots
+sink:
+  exchange: out
+`, []string{"shovel orders: source.prefetch: cannot unmarshal !!str `lots` into int"}},
+
+		{"list of shovels", `
+- name: orders
+  source:
+    queue: orders
+  sink:
+    exchange: out
+- name: invoices
+  source:
+    queue: invoices
+    prefetch: [1]
+  sinks:
+    - exchange: out
+      port: many
+`, []string{
+			"shovel invoices: sinks[0].port: cannot unmarshal !!str `many` into int",
+			"shovel invoices: source.prefetch: cannot unmarshal !!seq into int",
+		}},
+
+		{"nested values", `
+name: orders
+source:
+  queue: orders
+  bindings:
+    - exchange: in
+      routingkey: {a: b}
+sink:
+  exchange: out
+reconnect:
+  factor: fast
+`, []string{
+			"shovel orders: reconnect.factor: cannot unmarshal !!str `fast` into float64",
+			"shovel orders: source.bindings[0].routingkey: cannot unmarshal !!map into string",
+		}},
+
+		{"syntax error in a later document", `name: orders
+source:
+  queue: orders
+sink:
+  exchange: out
+---
+name: invoices
+source:
+  queue: [invoices
+`, []string{"yaml: line 9: did not find expected ',' or ']'"}},
+	}
+
+	for _, test := range tests {
+		_, err := ParseShovels(strings.NewReader(test.config))
+		problems, ok := err.(ConfigError)
+		if !ok {
+			t.Errorf("%s: error = %v, want a ConfigError", test.name, err)
+			continue
+		}
+
+		var got []string
+		for _, problem := range problems {
+			if strings.Contains(problem.Message, "unmarshal") || strings.HasPrefix(problem.Message, "yaml:") {
+				got = append(got, problem.String())
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got\n\t%s\nwant\n\t%s", test.name, strings.Join(got, "\n\t"), strings.Join(test.want, "\n\t"))
+		}
+	}
+}
+
+func TestParseShovelEnvTypes(t *testing.T) {
+	env := map[string]string{
+		"SHOVEL_TEST_PORT":        "5673",
+		"SHOVEL_TEST_PREFETCH":    "10",
+		"SHOVEL_TEST_MANDATORY":   "true",
+		"SHOVEL_TEST_ATTEMPTS":    "5",
+		"SHOVEL_TEST_DELAY":       "2s",
+		"SHOVEL_TEST_FACTOR":      "1.5",
+		"SHOVEL_TEST_PASSWORD":    "0123",
+		"SHOVEL_TEST_MAX_LENGTH":  "1000",
+		"SHOVEL_TEST_CONCURRENCY": "not a number",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	shovel, err := ParseShovel(strings.NewReader(`
+name: orders
+concurrency: ${SHOVEL_TEST_UNSET:-2}
+source:
+  port: ${SHOVEL_TEST_PORT}
+  password: ${SHOVEL_TEST_PASSWORD}
+  queue: orders
+  prefetch: ${SHOVEL_TEST_PREFETCH}
+  declare:
+    arguments:
+      x-max-length: ${SHOVEL_TEST_MAX_LENGTH}
+sink:
+  exchange: out
+  port: ${SHOVEL_TEST_PORT:-}
+  routingkey: ${SHOVEL_TEST_PORT}
+mandatory: ${SHOVEL_TEST_MANDATORY}
+deadletter:
+  exchange: dead
+  maxattempts: ${SHOVEL_TEST_ATTEMPTS}
+reconnect:
+  mindelay: ${SHOVEL_TEST_DELAY}
+  maxdelay: 1m
+  factor: ${SHOVEL_TEST_FACTOR}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, sink := shovel.Source, shovel.Sinks[0]
+	tests := []struct {
+		field     string
+		got, want interface{}
+	}{
+		{"concurrency", shovel.Concurrency, 2},
+		{"source.port", source.Port, 5673},
+		{"source.password", source.Password, "0123"},
+		{"source.queues[0].prefetch", source.Queues[0].Prefetch, 10},
+		{"source.queues[0].declare.arguments", source.Queues[0].Declare.Arguments["x-max-length"], 1000},
+		{"sink.port", sink.Port, 5673},
+		{"sink.routingkey", sink.RoutingKey, "5673"},
+		{"mandatory", shovel.Mandatory, true},
+		{"deadletter.maxattempts", shovel.DeadLetter.MaxAttempts, 5},
+		{"reconnect.mindelay", shovel.Reconnect.MinDelay, 2 * time.Second},
+		{"reconnect.factor", shovel.Reconnect.Factor, 1.5},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %#v, want %#v", test.field, test.got, test.want)
+		}
+	}
+
+	_, err = ParseShovel(strings.NewReader(`
+name: orders
+concurrency: ${SHOVEL_TEST_CONCURRENCY}
+source:
+  queue: orders
+sink:
+  exchange: out
+`))
+	want := "shovel orders: concurrency: cannot unmarshal !!str `not a n...` into int"
+	if err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %s", err, want)
+	}
+}
+
+func TestParseShovelQueues(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"queue and bindings", `
+  queue: orders
+  bindings:
+    - exchange: in
+  queues:
+    - queue: invoices
+`, []string{
+			"shovel orders: source.bindings: cannot be combined with queues",
+			"shovel orders: source.queue: cannot be combined with queues",
+		}},
+
+		{"inherited offset", `
+  type: stream
+  offset: bogus
+  queues:
+    - queue: orders
+`, []string{"shovel orders: source.queues[0].offset: must be first, last, next, an offset or an RFC 3339 timestamp"}},
+	}
+
+	for _, test := range tests {
+		_, err := ParseShovel(strings.NewReader("name: orders\nsink:\n  exchange: out\nsource:" + test.source))
+		var got []string
+		if problems, ok := err.(ConfigError); ok {
+			for _, problem := range problems {
+				got = append(got, problem.String())
+			}
+		} else if err != nil {
+			t.Errorf("%s: error = %v, want a ConfigError", test.name, err)
+			continue
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got\n\t%s\nwant\n\t%s", test.name, strings.Join(got, "\n\t"), strings.Join(test.want, "\n\t"))
+		}
+	}
+}
+
+func TestParseShovelQueuesInherit(t *testing.T) {
+	shovel, err := ParseShovel(strings.NewReader(`
+name: orders
+source:
+  prefetch: 10
+  declare: {passive: true}
+  type: stream
+  offset: first
+  queues:
+    - queue: orders
+    - queue: invoices
+      prefetch: 5
+sink:
+  exchange: out
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders, invoices := shovel.Source.Queues[0], shovel.Source.Queues[1]
+	tests := []struct {
+		field     string
+		got, want interface{}
+	}{
+		{"queues[0].prefetch", orders.Prefetch, 10},
+		{"queues[0].declare.passive", orders.Declare != nil && orders.Declare.Passive, true},
+		{"queues[0].type", orders.Type, "stream"},
+		{"queues[0].offset", orders.Offset, "first"},
+		{"queues[1].prefetch", invoices.Prefetch, 5},
+		{"queues[1].offset", invoices.Offset, "first"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %#v, want %#v", test.field, test.got, test.want)
+		}
+	}
+}
+
+func TestParseShovelURIConflicts(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{"uri with host and credentials", `
+name: orders
+source:
+  uri: amqp://rabbit.internal/
+  host: rabbit.internal
+  user: shoveld
+  password: secret
+  queue: orders
+sink:
+  exchange: out
+`, []string{
+			"shovel orders: source.host: cannot be combined with uri, uris or urifile",
+			"shovel orders: source.user: cannot be combined with uri, uris or urifile",
+			"shovel orders: source.password: cannot be combined with uri, uris or urifile",
+		}},
+
+		{"uris with port and vhost", `
+name: orders
+source:
+  queue: orders
+sinks:
+  - exchange: out
+  - exchange: out
+    uris:
+      - amqp://rabbit-0.internal/
+      - amqp://rabbit-1.internal/
+    port: 5673
+    vhost: fancy
+`, []string{
+			"shovel orders: sinks[1].port: cannot be combined with uri, uris or urifile",
+			"shovel orders: sinks[1].vhost: cannot be combined with uri, uris or urifile",
+		}},
+
+		{"uri with tls and a separate sink host", `
+name: orders
+source:
+  uri: amqps://rabbit.internal/
+  tls: {}
+  queue: orders
+sink:
+  host: rabbit.internal
+  exchange: out
+`, nil},
+	}
+
+	for _, test := range tests {
+		_, err := ParseShovel(strings.NewReader(test.config))
+		var got []string
+		if problems, ok := err.(ConfigError); ok {
+			for _, problem := range problems {
+				got = append(got, problem.String())
+			}
+		} else if err != nil {
+			t.Errorf("%s: error = %v, want a ConfigError", test.name, err)
+			continue
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got\n\t%s\nwant\n\t%s", test.name, strings.Join(got, "\n\t"), strings.Join(test.want, "\n\t"))
+		}
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	// addresses that refuse connections
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, listener.Addr().String())
+		listener.Close()
+	}
+
+	host := AMQPHost{URLs: []string{"amqp://shoveld:secret@" + addrs[0] + "/", "amqp://" + addrs[1] + "/fancy"}}
+	_, err := host.Dial()
+	if err == nil {
+		t.Fatal("dial succeeded")
+	}
+	for _, want := range []string{"amqp://shoveld:REDACTED@" + addrs[0] + "/: ", "; amqp://" + addrs[1] + "/fancy: "} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want it to contain %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error = %v, includes the password", err)
+	}
+
+	// a single URI's error is returned as it is
+	host = AMQPHost{URL: "amqp://shoveld:secret@" + addrs[0] + "/"}
+	if _, err := host.Dial(); err == nil || strings.Contains(err.Error(), "amqp://") {
+		t.Errorf("error = %v, want the dial error alone", err)
+	}
+}
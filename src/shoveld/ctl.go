@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// adminClient makes requests to the admin API of a running shoveld.
+type adminClient struct {
+	client  *http.Client
+	baseURL string
+}
+
+// newAdminClient connects to an address as given to -admin: host:port, an http URL, or unix:/path.
+func newAdminClient(addr string) *adminClient {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		transport := &http.Transport{Dial: func(network, address string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		}}
+		return &adminClient{&http.Client{Transport: transport}, "http://shoveld"}
+	}
+
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &adminClient{http.DefaultClient, strings.TrimSuffix(addr, "/")}
+}
+
+// do sends a request and decodes the JSON response into out, if not nil.
+func (c *adminClient) do(method, path string, out interface{}) error {
+	req, err := http.NewRequest(method, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct{ Error string }
+		if err := json.NewDecoder(resp.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return errors.New(resp.Status)
+		}
+		return errors.New(failure.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func pathEscape(segment string) string {
+	return (&url.URL{Path: segment}).EscapedPath()
+}
+
+// ctlCommand runs a command against the admin API of a running shoveld.
+func ctlCommand(args []string) {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	addr := flags.String("admin", os.Getenv("SHOVELD_ADMIN"), "admin API address, as given to shoveld -admin (default $SHOVELD_ADMIN)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s ctl: [-admin addr] command\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Commands:")
+		fmt.Fprintln(os.Stderr, "  list                       list shovels")
+		fmt.Fprintln(os.Stderr, "  status NAME                show a shovel's workers and config")
+		fmt.Fprintln(os.Stderr, "  pause|resume|restart NAME [WORKER]")
+		fmt.Fprintln(os.Stderr, "                             act on every worker of a shovel, or just one")
+		fmt.Fprintln(os.Stderr, "  reload                     re-read the config files")
+		fmt.Fprintln(os.Stderr)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *addr == "" || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := runCtl(newAdminClient(*addr), os.Stdout, flags.Arg(0), flags.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func runCtl(client *adminClient, out io.Writer, command string, args []string) error {
+	switch {
+	case command == "list" && len(args) == 0:
+		var statuses []ShovelStatus
+		if err := client.do("GET", "/shovels", &statuses); err != nil {
+			return err
+		}
+
+		table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "NAME\tWORKERS\tSTATE\tCONSUMED\tACKED\tNACKED\tINFLIGHT")
+		for _, status := range statuses {
+			var total WorkerStatus
+			states := make(map[string]int)
+			var order []string
+			for _, worker := range status.Workers {
+				total.Consumed += worker.Consumed
+				total.Acked += worker.Acked
+				total.Nacked += worker.Nacked
+				total.Inflight += worker.Inflight
+				if states[worker.State] == 0 {
+					order = append(order, worker.State)
+				}
+				states[worker.State]++
+			}
+			summary := make([]string, len(order))
+			for i, state := range order {
+				summary[i] = fmt.Sprintf("%d %s", states[state], state)
+			}
+			fmt.Fprintf(table, "%s\t%d\t%s\t%d\t%d\t%d\t%d\n", status.Name, len(status.Workers), strings.Join(summary, ", "),
+				total.Consumed, total.Acked, total.Nacked, total.Inflight)
+		}
+		return table.Flush()
+
+	case command == "status" && len(args) == 1:
+		var status ShovelStatus
+		if err := client.do("GET", "/shovels/"+pathEscape(args[0]), &status); err != nil {
+			return err
+		}
+
+		table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "WORKER\tSTATE\tCONSUMED\tPUBLISHED\tACKED\tNACKED\tREPUBLISHED\tDROPPED\tFILTERED\t"+
+			"RETRIED\tDEAD-LETTERED\tRETURNED\tFAILED\tRECONNECTS\tINFLIGHT")
+		for _, w := range status.Workers {
+			fmt.Fprintf(table, "%d\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", w.Worker, w.State,
+				w.Consumed, w.Published, w.Acked, w.Nacked, w.Republished, w.Dropped, w.Filtered,
+				w.Retried, w.DeadLettered, w.Returned, w.Failed, w.Reconnects, w.Inflight)
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+
+		config, err := json.MarshalIndent(status.Config, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "\n%s\n", config)
+		return nil
+
+	case (command == "pause" || command == "resume" || command == "restart") && (len(args) == 1 || len(args) == 2):
+		path := "/shovels/" + pathEscape(args[0])
+		if len(args) == 2 {
+			path += "/workers/" + pathEscape(args[1])
+		}
+		return client.do("POST", path+"/"+command, nil)
+
+	case command == "reload" && len(args) == 0:
+		return client.do("POST", "/reload", nil)
+	}
+
+	return fmt.Errorf("unknown command or wrong arguments: %s %s (see -h)", command, strings.Join(args, " "))
+}
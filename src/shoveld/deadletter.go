@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ShovelDeadLetter limits how often a message the sink rejects is retried.
+// Retries are republished to the end of the source queue with an x-shovel-attempts header,
+// and once MaxAttempts is reached the message goes to Exchange on the source broker instead,
+// with headers describing the failure. RoutingKey is optional and overrides the message's.
+type ShovelDeadLetter struct {
+	Exchange    string
+	RoutingKey  string
+	MaxAttempts int
+}
+
+// Headers added to retried and dead-lettered messages. The exchange and routing key
+// are those the message was originally consumed with, restored when it is retried.
+const (
+	attemptsHeader   = "x-shovel-attempts"
+	exchangeHeader   = "x-shovel-exchange"
+	routingKeyHeader = "x-shovel-routing-key"
+)
+
+// failure is a delivery that could not be shoveled, waiting to be retried or dead-lettered.
+// Without retry it is dead-lettered straight away.
+type failure struct {
+	*publishing
+	reason string
+	retry  bool
+}
+
+// attempts returns how many times a delivery has already failed, from its x-shovel-attempts
+// header or, if the source queue dead-letters messages itself, the counts in its x-death header.
+func attempts(msg amqp.Delivery) int64 {
+	n := headerInt(msg.Headers[attemptsHeader])
+	if deaths, ok := msg.Headers["x-death"].([]interface{}); ok {
+		var died int64
+		for _, death := range deaths {
+			if table, ok := death.(amqp.Table); ok {
+				died += headerInt(table["count"])
+			}
+		}
+		if died > n {
+			n = died
+		}
+	}
+	return n
+}
+
+// restoreRetried gives a retried delivery back the exchange and routing key it was first consumed with.
+func restoreRetried(msg *amqp.Delivery) {
+	routingKey, ok := msg.Headers[routingKeyHeader].(string)
+	if !ok || msg.Exchange != "" {
+		return
+	}
+	msg.RoutingKey = routingKey
+	msg.Exchange, _ = msg.Headers[exchangeHeader].(string)
+
+	headers := make(amqp.Table, len(msg.Headers))
+	for k, v := range msg.Headers {
+		if k != exchangeHeader && k != routingKeyHeader {
+			headers[k] = v
+		}
+	}
+	msg.Headers = headers
+}
+
+// headerInt converts a header value of any integer type, returning 0 for anything else.
+func headerInt(value interface{}) int64 {
+	switch v := value.(type) {
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	}
+	return 0
+}
+
+// deadLetter retries or dead-letters failed deliveries one at a time over channel, a confirming
+// channel on the source connection, until done is closed. Each delivery is acked on the source
+// once the broker confirms its copy, and requeued if it doesn't. release is called after each one.
+func (w *Worker) deadLetter(channel *amqp.Channel, confirms <-chan amqp.Confirmation, failures <-chan failure, done <-chan struct{}, release func()) {
+	for {
+		var f failure
+		select {
+		case f = <-failures:
+		case <-done:
+			return
+		}
+
+		exchange, routingKey, out, dead := w.failed(f)
+		err := channel.Publish(exchange, routingKey, false, false, out.Publishing)
+		if err == nil {
+			if confirmed, ok := <-confirms; !ok {
+				err = fmt.Errorf("channel closed")
+			} else if !confirmed.Ack {
+				err = fmt.Errorf("nacked by the source broker")
+			}
+		}
+
+		if err != nil {
+			w.log.Warn("failed to republish rejected message", "exchange", exchange, "routing_key", routingKey, "error", err)
+			f.Nack(false, true)
+		} else {
+			f.Ack(false)
+			if dead {
+				atomic.AddUint64(&w.metrics.deadLettered, 1)
+			} else {
+				atomic.AddUint64(&w.metrics.retried, 1)
+			}
+		}
+		release()
+	}
+}
+
+// failed returns the copy of a failed delivery to publish, where to publish it,
+// and whether that is the dead-letter exchange rather than the source queue.
+func (w *Worker) failed(f failure) (string, string, *message, bool) {
+	queue := w.Source.Queues[f.queue].Queue
+	n := attempts(f.Delivery) + 1
+
+	out := newMessage(f.Delivery, f.RoutingKey)
+	out.setHeader(attemptsHeader, n)
+	out.setHeader(exchangeHeader, f.Exchange)
+	out.setHeader(routingKeyHeader, f.RoutingKey)
+	if f.retry && n < int64(w.DeadLetter.MaxAttempts) {
+		// the default exchange routes straight back to the source queue
+		return "", queue, out, false
+	}
+
+	w.log.Warn("dead-lettering message", "reason", f.reason, "attempts", n,
+		"routing_key", f.RoutingKey, "message_id", f.MessageId)
+	out.setHeader("x-shovel-failure", f.reason)
+	out.setHeader("x-shovel-failed-at", time.Now())
+	out.setHeader("x-shovel-name", w.Name)
+	out.setHeader("x-shovel-queue", queue)
+	if w.DeadLetter.RoutingKey != "" {
+		out.routingKey = w.DeadLetter.RoutingKey
+	}
+	return w.DeadLetter.Exchange, out.routingKey, out, true
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// ShovelMatch selects messages; every condition that is set must hold.
+// RoutingKey is an AMQP topic pattern, where * matches one word and # matches zero or more.
+// Headers and Properties must have the given values, and Body maps dotted paths
+// into a JSON body, such as customer.country, to the values they must have.
+type ShovelMatch struct {
+	RoutingKey string
+	Headers    map[string]string
+	Properties map[string]string
+	Body       map[string]string
+}
+
+// ShovelFilter only lets messages that match through to the sink.
+// Otherwise is what happens to the rest: drop acks them on the source, requeue nacks them
+// back onto the source queue for another consumer, and route publishes them unchanged
+// to Route's exchange over the sink connection.
+type ShovelFilter struct {
+	Match     ShovelMatch
+	Otherwise string
+	Route     ShovelRoute
+}
+
+// ShovelRoute is an alternative destination on the sink.
+// RoutingKey is optional and overrides a message's routing key if specified.
+type ShovelRoute struct {
+	Exchange   string
+	RoutingKey string
+}
+
+// Actions for messages that don't match a filter.
+const (
+	filterDrop    = "drop"
+	filterRequeue = "requeue"
+	filterRoute   = "route"
+)
+
+// messageProperties reads the properties a ShovelMatch can test, by name.
+var messageProperties = map[string]func(p *amqp.Publishing) string{
+	"contenttype":     func(p *amqp.Publishing) string { return p.ContentType },
+	"contentencoding": func(p *amqp.Publishing) string { return p.ContentEncoding },
+	"deliverymode":    func(p *amqp.Publishing) string { return fmt.Sprint(p.DeliveryMode) },
+	"priority":        func(p *amqp.Publishing) string { return fmt.Sprint(p.Priority) },
+	"correlationid":   func(p *amqp.Publishing) string { return p.CorrelationId },
+	"replyto":         func(p *amqp.Publishing) string { return p.ReplyTo },
+	"expiration":      func(p *amqp.Publishing) string { return p.Expiration },
+	"messageid":       func(p *amqp.Publishing) string { return p.MessageId },
+	"type":            func(p *amqp.Publishing) string { return p.Type },
+	"userid":          func(p *amqp.Publishing) string { return p.UserId },
+	"appid":           func(p *amqp.Publishing) string { return p.AppId },
+}
+
+// check reports conditions that can never be tested.
+func (s ShovelMatch) check() error {
+	for name := range s.Properties {
+		if messageProperties[name] == nil {
+			return fmt.Errorf("unknown property %q", name)
+		}
+	}
+	return nil
+}
+
+func (f ShovelFilter) validate(prefix string) []FieldError {
+	var problems []FieldError
+	if err := f.Match.check(); err != nil {
+		problems = append(problems, FieldError{Field: prefix + ".match", Message: err.Error()})
+	}
+	switch f.Otherwise {
+	case "", filterDrop, filterRequeue:
+	case filterRoute:
+		if f.Route.Exchange == "" {
+			problems = append(problems, FieldError{Field: prefix + ".route.exchange", Message: "required"})
+		}
+	default:
+		problems = append(problems, FieldError{Field: prefix + ".otherwise", Message: "must be drop, requeue or route"})
+	}
+	return problems
+}
+
+func (s ShovelMatch) matches(m *message) bool {
+	if s.RoutingKey != "" && !topicMatch(s.RoutingKey, m.routingKey) {
+		return false
+	}
+	for key, value := range s.Headers {
+		if header, ok := m.Headers[key]; !ok || fmt.Sprint(header) != value {
+			return false
+		}
+	}
+	for name, value := range s.Properties {
+		if property := messageProperties[name]; property == nil || property(&m.Publishing) != value {
+			return false
+		}
+	}
+	if len(s.Body) > 0 {
+		return matchBody(s.Body, m.Body)
+	}
+	return true
+}
+
+// matchBody reports whether a JSON body has every field at the given dotted paths set to the given values.
+// Bodies that aren't JSON objects never match.
+func matchBody(fields map[string]string, body []byte) bool {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return false
+	}
+
+	for path, value := range fields {
+		field := doc
+		for _, name := range strings.Split(path, ".") {
+			object, ok := field.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			if field, ok = object[name]; !ok {
+				return false
+			}
+		}
+		if field == nil || fmt.Sprint(field) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatch reports whether a routing key matches an AMQP topic pattern.
+func topicMatch(pattern, key string) bool {
+	return matchWords(topicWords(pattern), topicWords(key))
+}
+
+// topicWords splits a routing key or pattern into words. Like the broker, it
+// takes an empty key to have no words, but a dot next to nothing as an empty word.
+func topicWords(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, ".")
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && words[0] == pattern[0] && matchWords(pattern[1:], words[1:])
+	}
+}
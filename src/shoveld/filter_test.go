@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.updated", false},
+		{"orders", "orders.created", false},
+
+		// # matches any number of words, including none
+		{"#", "", true},
+		{"#", "orders.created", true},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.us.created", true},
+		{"#.created", "created", true},
+		{"orders.#.created", "orders.created", true},
+		{"orders.#.created", "orders.us.eu.created", true},
+		{"orders.#.created", "orders.us.updated", false},
+		{"#.#", "", true},
+
+		// * matches exactly one word, which may be empty
+		{"*", "", false},
+		{"*", "orders", true},
+		{"*", "orders.created", false},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.", true},
+		{"*.created", ".created", true},
+		{"orders.*.created", "orders..created", true},
+		{"*.*", "orders", false},
+
+		{"", "", true},
+		{"", "orders", false},
+	}
+
+	for _, test := range tests {
+		if got := topicMatch(test.pattern, test.key); got != test.want {
+			t.Errorf("topicMatch(%q, %q) = %v, want %v", test.pattern, test.key, got, test.want)
+		}
+	}
+}
+
+func TestMatchBody(t *testing.T) {
+	tests := []struct {
+		body   string
+		fields map[string]string
+		want   bool
+	}{
+		{`{"country": "DE"}`, map[string]string{"country": "DE"}, true},
+		{`{"country": "FR"}`, map[string]string{"country": "DE"}, false},
+		{`{"country": "DE", "total": 12}`, map[string]string{"country": "DE", "total": "12"}, true},
+		{`{"country": "DE", "total": 12}`, map[string]string{"country": "DE", "total": "13"}, false},
+		{`{"total": 12345678901234567890}`, map[string]string{"total": "12345678901234567890"}, true},
+		{`{"total": 1.5, "paid": true}`, map[string]string{"total": "1.5", "paid": "true"}, true},
+		{`{"country": null}`, map[string]string{"country": ""}, false},
+
+		// dotted paths descend into nested objects
+		{`{"customer": {"address": {"country": "DE"}}}`, map[string]string{"customer.address.country": "DE"}, true},
+		{`{"customer": {"address": {"country": "DE"}}}`, map[string]string{"customer.address.city": "Berlin"}, false},
+		{`{"customer": {"address": "Berlin, DE"}}`, map[string]string{"customer.address.country": "DE"}, false},
+		{`{"customer": [{"country": "DE"}]}`, map[string]string{"customer.0.country": "DE"}, false},
+		{`{"customer.country": "DE"}`, map[string]string{"customer.country": "DE"}, false},
+
+		// bodies that aren't JSON objects never match
+		{`["DE"]`, map[string]string{"0": "DE"}, false},
+		{`"DE"`, map[string]string{"country": "DE"}, false},
+		{`12`, map[string]string{"country": "DE"}, false},
+		{`country=DE`, map[string]string{"country": "DE"}, false},
+		{`{"country": "DE"`, map[string]string{"country": "DE"}, false},
+		{``, map[string]string{"country": "DE"}, false},
+	}
+
+	for _, test := range tests {
+		if got := matchBody(test.fields, []byte(test.body)); got != test.want {
+			t.Errorf("matchBody(%v, %s) = %v, want %v", test.fields, test.body, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readyHandler reports ready once every worker has an open consumer or has been paused.
+func readyHandler(registry *metricsRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		keys, workers := registry.snapshot()
+
+		var waiting []string
+		for _, key := range keys {
+			if workers[key].getState() != statePaused && workers[key].disconnected() > 0 {
+				waiting = append(waiting, fmt.Sprintf("%s [%d] not consuming", key.shovel, key.worker))
+			}
+		}
+		writeStatus(w, waiting)
+	}
+}
+
+// healthHandler reports unhealthy while any worker that isn't paused has been without a consumer for longer than threshold.
+func healthHandler(registry *metricsRegistry, threshold time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		keys, workers := registry.snapshot()
+
+		var failing []string
+		for _, key := range keys {
+			if d := workers[key].disconnected(); d > threshold && workers[key].getState() != statePaused {
+				failing = append(failing, fmt.Sprintf("%s [%d] disconnected for %s", key.shovel, key.worker, d))
+			}
+		}
+		writeStatus(w, failing)
+	}
+}
+
+// writeStatus responds 200 if there are no problems, otherwise 503 listing them.
+func writeStatus(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// publishing is a source delivery that has been published to one or more sinks.
+// It is finished once every sink has confirmed it, and nacked if any of them nacked it.
+// returned explains why a sink returned it as unroutable, if one did.
+type publishing struct {
+	amqp.Delivery
+	queue     int // index of the source queue
+	published time.Time
+	targets   []target
+	seqs      []uint64
+	returns   []bool // whether each target has been matched to a return
+	remaining int
+	nacked    bool
+	returned  string
+}
+
+// inflight maps each sink's publish sequence numbers to the source deliveries they were copied from.
+// A new inflight is needed whenever the sink channels are reopened, since sequence numbers restart at 1.
+type inflight struct {
+	m           sync.Mutex
+	deliveries  []map[uint64]*publishing // indexed by sink
+	published   []uint64
+	outstanding map[*publishing]bool
+}
+
+func newInflight(sinks int) *inflight {
+	f := &inflight{
+		deliveries:  make([]map[uint64]*publishing, sinks),
+		published:   make([]uint64, sinks),
+		outstanding: map[*publishing]bool{}}
+	for i := range f.deliveries {
+		f.deliveries[i] = map[uint64]*publishing{}
+	}
+	return f
+}
+
+// add records msg, consumed from the given source queue, against the next publish sequence
+// number of each target's sink. It must be called before publishing so a fast confirm can
+// always be matched, and the targets must then be published in the order given.
+func (f *inflight) add(msg amqp.Delivery, queue int, targets []target) *publishing {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	p := &publishing{Delivery: msg, queue: queue, published: time.Now(), targets: targets,
+		returns: make([]bool, len(targets)), remaining: len(targets)}
+	for _, t := range targets {
+		f.published[t.sink]++
+		f.deliveries[t.sink][f.published[t.sink]] = p
+		p.seqs = append(p.seqs, f.published[t.sink])
+	}
+	f.outstanding[p] = true
+	return p
+}
+
+// remove forgets a delivery after a failed publish to the target at index sent.
+// Sequence numbers of that target and the later ones, which were never used, are given back.
+func (f *inflight) remove(p *publishing, sent int) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	for i, t := range p.targets {
+		delete(f.deliveries[t.sink], p.seqs[i])
+		if i >= sent && p.seqs[i] == f.published[t.sink] {
+			f.published[t.sink]--
+		}
+	}
+	delete(f.outstanding, p)
+}
+
+// confirm records a sink's confirmation of tag, returning the delivery
+// once it has been confirmed by every sink it was published to. The library
+// splits multiple confirms into one per tag, so tag is a single publish.
+func (f *inflight) confirm(sink int, tag uint64, ack bool) (*publishing, bool) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	p, ok := f.deliveries[sink][tag]
+	if !ok {
+		return nil, false
+	}
+	delete(f.deliveries[sink], tag)
+
+	p.nacked = p.nacked || !ack
+	p.remaining--
+	if p.remaining > 0 {
+		return nil, false
+	}
+	delete(f.outstanding, p)
+	return p, true
+}
+
+// returned marks the unconfirmed publish to a sink that a return refers to. Returns don't carry
+// sequence numbers, so it is the oldest publish with the same destination, message ID and body
+// that hasn't been returned yet; identical messages are interchangeable. The broker always
+// returns a message before confirming it, so the publish is still unconfirmed.
+func (f *inflight) returned(sink int, r amqp.Return) *publishing {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	var oldest uint64
+	var match *publishing
+	var index int
+	for seq, p := range f.deliveries[sink] {
+		if match != nil && seq > oldest {
+			continue
+		}
+		for i, t := range p.targets {
+			if t.sink == sink && !p.returns[i] && t.exchange == r.Exchange && t.message.routingKey == r.RoutingKey &&
+				t.message.MessageId == r.MessageId && bytes.Equal(t.message.Body, r.Body) {
+				oldest, match, index = seq, p, i
+			}
+		}
+	}
+
+	if match != nil {
+		match.returns[index] = true
+		match.returned = fmt.Sprintf("returned by %s: %d %s", exchangeName(r.Exchange), r.ReplyCode, r.ReplyText)
+	}
+	return match
+}
+
+// drain removes and returns every unconfirmed delivery.
+func (f *inflight) drain() []*publishing {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	var remaining []*publishing
+	for p := range f.outstanding {
+		remaining = append(remaining, p)
+	}
+	for i := range f.deliveries {
+		f.deliveries[i] = map[uint64]*publishing{}
+	}
+	f.outstanding = map[*publishing]bool{}
+	return remaining
+}
+
+// exchangeName names an exchange for messages, including the default exchange.
+func exchangeName(exchange string) string {
+	if exchange == "" {
+		return "default exchange"
+	}
+	return "exchange " + exchange
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// testTarget returns a target publishing body to the given sink.
+func testTarget(sink int, body string) target {
+	msg := newMessage(amqp.Delivery{MessageId: body, Body: []byte(body)}, "key")
+	return target{sink: sink, exchange: "out", message: msg}
+}
+
+// testDelivery returns a source delivery with the given tag, named by its message ID.
+func testDelivery(tag uint64, id string) amqp.Delivery {
+	return amqp.Delivery{DeliveryTag: tag, MessageId: id, Body: []byte(id)}
+}
+
+func TestInflightSequences(t *testing.T) {
+	f := newInflight(2)
+	a := f.add(testDelivery(1, "a"), 0, []target{testTarget(0, "a"), testTarget(1, "a")})
+	b := f.add(testDelivery(2, "b"), 0, []target{testTarget(1, "b")})
+	c := f.add(testDelivery(3, "c"), 0, []target{testTarget(0, "c"), testTarget(1, "c")})
+
+	tests := []struct {
+		p    *publishing
+		seqs []uint64
+	}{
+		{a, []uint64{1, 1}},
+		{b, []uint64{2}},
+		{c, []uint64{2, 3}},
+	}
+	for _, test := range tests {
+		if len(test.p.seqs) != len(test.seqs) {
+			t.Fatalf("%s: seqs = %v, want %v", test.p.MessageId, test.p.seqs, test.seqs)
+		}
+		for i := range test.seqs {
+			if test.p.seqs[i] != test.seqs[i] {
+				t.Errorf("%s: seqs = %v, want %v", test.p.MessageId, test.p.seqs, test.seqs)
+			}
+		}
+	}
+}
+
+func TestInflightConfirm(t *testing.T) {
+	type confirm struct {
+		sink int
+		tag  uint64
+		ack  bool
+		done string // message ID of the delivery finished by the confirm, if any
+	}
+
+	tests := []struct {
+		name     string
+		confirms []confirm
+		nacked   map[string]bool
+	}{
+		{"in order", []confirm{
+			{0, 1, true, ""}, {1, 1, true, "a"},
+			{1, 2, true, "b"},
+			{0, 2, true, ""}, {1, 3, true, "c"},
+		}, nil},
+		{"out of order", []confirm{
+			{1, 3, true, ""}, {1, 2, true, "b"},
+			{0, 2, true, "c"},
+			{1, 1, true, ""}, {0, 1, true, "a"},
+		}, nil},
+		{"nacked by one sink", []confirm{
+			{0, 1, false, ""}, {1, 1, true, "a"},
+			{1, 2, false, "b"},
+			{0, 2, true, ""}, {1, 3, true, "c"},
+		}, map[string]bool{"a": true, "b": true}},
+		{"unknown and repeated tags", []confirm{
+			{0, 5, true, ""}, {1, 4, true, ""},
+			{0, 1, true, ""}, {0, 1, true, ""},
+			{1, 2, true, "b"}, {1, 2, true, ""},
+		}, nil},
+	}
+
+	for _, test := range tests {
+		f := newInflight(2)
+		f.add(testDelivery(1, "a"), 0, []target{testTarget(0, "a"), testTarget(1, "a")})
+		f.add(testDelivery(2, "b"), 0, []target{testTarget(1, "b")})
+		f.add(testDelivery(3, "c"), 0, []target{testTarget(0, "c"), testTarget(1, "c")})
+
+		for i, c := range test.confirms {
+			p, done := f.confirm(c.sink, c.tag, c.ack)
+			switch {
+			case done != (c.done != ""):
+				t.Errorf("%s: confirm %d: done = %v, want %v", test.name, i, done, c.done != "")
+			case done && p.MessageId != c.done:
+				t.Errorf("%s: confirm %d finished %s, want %s", test.name, i, p.MessageId, c.done)
+			case done && p.nacked != test.nacked[c.done]:
+				t.Errorf("%s: confirm %d: nacked = %v, want %v", test.name, i, p.nacked, test.nacked[c.done])
+			}
+		}
+	}
+}
+
+func TestInflightRemove(t *testing.T) {
+	f := newInflight(3)
+	f.add(testDelivery(1, "a"), 0, []target{testTarget(0, "a"), testTarget(1, "a"), testTarget(2, "a")})
+
+	// publishing to sink 1 fails, so sink 0 used sequence number 2 and the others never did
+	b := f.add(testDelivery(2, "b"), 0, []target{testTarget(0, "b"), testTarget(1, "b"), testTarget(2, "b")})
+	f.remove(b, 1)
+
+	if _, done := f.confirm(0, 2, true); done {
+		t.Errorf("confirm of a removed delivery finished it")
+	}
+	if remaining := f.drain(); len(remaining) != 1 || remaining[0].MessageId != "a" {
+		t.Errorf("drain = %v, want only a", remaining)
+	}
+
+	f = newInflight(3)
+	f.add(testDelivery(1, "a"), 0, []target{testTarget(0, "a"), testTarget(1, "a"), testTarget(2, "a")})
+	b = f.add(testDelivery(2, "b"), 0, []target{testTarget(0, "b"), testTarget(1, "b"), testTarget(2, "b")})
+	f.remove(b, 1)
+	c := f.add(testDelivery(3, "c"), 0, []target{testTarget(0, "c"), testTarget(1, "c"), testTarget(2, "c")})
+
+	want := []uint64{3, 2, 2}
+	for i := range want {
+		if c.seqs[i] != want[i] {
+			t.Fatalf("seqs after a failed publish = %v, want %v", c.seqs, want)
+		}
+	}
+	for i, tag := range want {
+		p, done := f.confirm(i, tag, true)
+		if done != (i == 2) || done && p.MessageId != "c" {
+			t.Errorf("confirm of sink %d tag %d: done = %v", i, tag, done)
+		}
+	}
+}
+
+func TestInflightDrain(t *testing.T) {
+	f := newInflight(2)
+	f.add(testDelivery(1, "a"), 0, []target{testTarget(0, "a"), testTarget(1, "a")})
+	f.add(testDelivery(2, "b"), 1, []target{testTarget(1, "b")})
+	f.confirm(0, 1, true)
+	f.confirm(1, 2, true)
+
+	remaining := f.drain()
+	if len(remaining) != 1 || remaining[0].MessageId != "a" {
+		t.Fatalf("drain = %v, want only a", remaining)
+	}
+	if _, done := f.confirm(1, 1, true); done {
+		t.Errorf("confirm after drain finished a delivery")
+	}
+	if remaining := f.drain(); len(remaining) != 0 {
+		t.Errorf("second drain = %v, want nothing", remaining)
+	}
+
+	// channels reopened after a reconnect number their publishes from 1 again
+	f = newInflight(2)
+	p := f.add(testDelivery(1, "c"), 0, []target{testTarget(0, "c"), testTarget(1, "c")})
+	if p.seqs[0] != 1 || p.seqs[1] != 1 {
+		t.Errorf("seqs after a reconnect = %v, want [1 1]", p.seqs)
+	}
+}
+
+func TestInflightReturned(t *testing.T) {
+	tests := []struct {
+		name   string
+		sink   int
+		r      amqp.Return
+		wantID string
+	}{
+		{"oldest identical publish", 0, amqp.Return{Exchange: "out", RoutingKey: "key", MessageId: "a", Body: []byte("a"), ReplyCode: 312}, "a1"},
+		{"next identical publish", 0, amqp.Return{Exchange: "out", RoutingKey: "key", MessageId: "a", Body: []byte("a"), ReplyCode: 312}, "a2"},
+		{"no identical publish left", 0, amqp.Return{Exchange: "out", RoutingKey: "key", MessageId: "a", Body: []byte("a"), ReplyCode: 312}, ""},
+		{"different body", 0, amqp.Return{Exchange: "out", RoutingKey: "key", MessageId: "b", Body: []byte("x"), ReplyCode: 312}, ""},
+		{"different routing key", 0, amqp.Return{Exchange: "out", RoutingKey: "other", MessageId: "b", Body: []byte("b"), ReplyCode: 312}, ""},
+		{"other sink", 1, amqp.Return{Exchange: "out", RoutingKey: "key", MessageId: "b", Body: []byte("b"), ReplyCode: 312}, "b"},
+	}
+
+	f := newInflight(2)
+	f.add(testDelivery(1, "a1"), 0, []target{testTarget(0, "a")})
+	f.add(testDelivery(2, "a2"), 0, []target{testTarget(0, "a")})
+	f.add(testDelivery(3, "b"), 0, []target{testTarget(1, "b")})
+
+	for _, test := range tests {
+		p := f.returned(test.sink, test.r)
+		switch {
+		case p == nil && test.wantID != "":
+			t.Errorf("%s: no match, want %s", test.name, test.wantID)
+		case p != nil && p.MessageId != test.wantID:
+			t.Errorf("%s: matched %s, want %q", test.name, p.MessageId, test.wantID)
+		case p != nil && p.returned == "":
+			t.Errorf("%s: no reason recorded", test.name)
+		}
+	}
+
+	// the confirm that follows a return still finishes the delivery, as returned
+	p, done := f.confirm(0, 1, true)
+	if !done || p.MessageId != "a1" || p.returned != "returned by exchange out: 312 " {
+		t.Errorf("confirm after return = %v, %v", p, done)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envReference matches ${VAR} and ${VAR:-fallback} references, and $$ escapes.
+var envReference = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// optionalEnvReference matches a value consisting of just ${VAR:-}.
+var optionalEnvReference = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*):-\}$`)
+
+// wholeEnvReference matches a value consisting of just one ${VAR} or ${VAR:-fallback} reference.
+var wholeEnvReference = regexp.MustCompile(`^\$\{[A-Za-z_][A-Za-z0-9_]*(:-[^}]*)?\}$`)
+
+// envExpander replaces environment variable references in a decoded YAML value.
+// A reference to an unset variable is a problem unless it has a fallback.
+// A value of just ${VAR:-} is removed when VAR is unset, so the field keeps its default.
+// A value of just one reference is read as a YAML scalar once expanded, unless it is
+// for a string field, so that numbers, booleans and durations can come from the environment.
+type envExpander struct {
+	problems []FieldError
+	changed  bool
+}
+
+// expand expands the references in value, which is decoded into a field of type t, or nil if unknown.
+func (e *envExpander) expand(path string, value interface{}, t reflect.Type) (interface{}, bool) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch value := value.(type) {
+	case string:
+		if match := optionalEnvReference.FindStringSubmatch(value); match != nil {
+			e.changed = true
+			variable, ok := os.LookupEnv(match[1])
+			return scalar(variable, t), ok
+		}
+
+		expanded := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+			e.changed = true
+			if reference == "$$" {
+				return "$"
+			}
+
+			match := envReference.FindStringSubmatch(reference)
+			if variable, ok := os.LookupEnv(match[1]); ok {
+				return variable
+			}
+			if match[2] == "" {
+				e.problems = append(e.problems, FieldError{Field: path, Message: fmt.Sprintf("environment variable %s is not set", match[1])})
+			}
+			return match[3]
+		})
+		if wholeEnvReference.MatchString(value) {
+			return scalar(expanded, t), true
+		}
+		return expanded, true
+
+	case map[interface{}]interface{}:
+		var fields map[string]reflect.Type
+		if t != nil && t.Kind() == reflect.Struct {
+			fields = yamlFields(t)
+		}
+		expanded := make(map[interface{}]interface{}, len(value))
+		for k, v := range value {
+			key := fmt.Sprint(k)
+			if path != "" {
+				key = path + "." + key
+			}
+			var field reflect.Type
+			if fields != nil {
+				field = fields[fmt.Sprint(k)]
+			} else if t != nil && t.Kind() == reflect.Map {
+				field = t.Elem()
+			}
+			if v, keep := e.expand(key, v, field); keep {
+				expanded[k] = v
+			}
+		}
+		return expanded, true
+
+	case []interface{}:
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			elem = t.Elem()
+		}
+		expanded := make([]interface{}, len(value))
+		for i, v := range value {
+			expanded[i], _ = e.expand(fmt.Sprintf("%s[%d]", path, i), v, elem)
+		}
+		return expanded, true
+	}
+
+	return value, true
+}
+
+// scalar reads an expanded value as a plain YAML scalar, as if it had been written in the config,
+// unless t is a string type. Values that aren't a single scalar are kept as strings.
+func scalar(text string, t reflect.Type) interface{} {
+	if t != nil && t.Kind() == reflect.String {
+		return text
+	}
+
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(text), &value); err != nil || value == nil {
+		return text
+	}
+	switch value.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		return text
+	}
+	return value
+}
+
+// readSecret returns the contents of a mounted secret file without trailing newlines.
+func readSecret(filename string) (string, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(bytes), "\r\n"), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line.
+type Level int
+
+// Log levels, from most to least verbose.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the Level with the given name.
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// logOutput is where every Logger writes, and how.
+var logOutput = struct {
+	sync.Mutex
+	w     io.Writer
+	json  bool
+	level Level
+}{w: os.Stderr, level: LevelInfo}
+
+// configureLogging sets the output format, "logfmt" or "json", and the minimum level logged.
+func configureLogging(format, level string) error {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+
+	switch format {
+	case "logfmt":
+		logOutput.json = false
+	case "json":
+		logOutput.json = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	var err error
+	logOutput.level, err = ParseLevel(level)
+	return err
+}
+
+// Logger writes leveled, structured log lines carrying a fixed set of fields.
+// Fields are given as alternating keys and values.
+type Logger struct {
+	fields []interface{}
+}
+
+// logger is the process-wide Logger, without any fields.
+var logger Logger
+
+// With returns a Logger that adds the given fields to every line.
+func (l Logger) With(fields ...interface{}) Logger {
+	return Logger{append(append([]interface{}(nil), l.fields...), fields...)}
+}
+
+// Enabled reports whether lines at level are written.
+func (l Logger) Enabled(level Level) bool {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+
+	return level >= logOutput.level
+}
+
+// Debug logs at LevelDebug.
+func (l Logger) Debug(msg string, fields ...interface{}) { l.log(LevelDebug, msg, fields) }
+
+// Info logs at LevelInfo.
+func (l Logger) Info(msg string, fields ...interface{}) { l.log(LevelInfo, msg, fields) }
+
+// Warn logs at LevelWarn.
+func (l Logger) Warn(msg string, fields ...interface{}) { l.log(LevelWarn, msg, fields) }
+
+// Error logs at LevelError.
+func (l Logger) Error(msg string, fields ...interface{}) { l.log(LevelError, msg, fields) }
+
+// Fatal logs at LevelError and exits.
+func (l Logger) Fatal(msg string, fields ...interface{}) {
+	l.log(LevelError, msg, fields)
+	os.Exit(1)
+}
+
+func (l Logger) log(level Level, msg string, fields []interface{}) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+
+	if level < logOutput.level {
+		return
+	}
+
+	all := []interface{}{"time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg}
+	all = append(append(all, l.fields...), fields...)
+
+	var line bytes.Buffer
+	if logOutput.json {
+		line.WriteByte('{')
+	}
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(all) {
+			value = all[i+1]
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+
+		if logOutput.json {
+			if i > 0 {
+				line.WriteByte(',')
+			}
+			encodedKey, _ := json.Marshal(key)
+			line.Write(encodedKey)
+			line.WriteByte(':')
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				encoded, _ = json.Marshal(fmt.Sprint(value))
+			}
+			line.Write(encoded)
+		} else {
+			if i > 0 {
+				line.WriteByte(' ')
+			}
+			line.WriteString(key)
+			line.WriteByte('=')
+			line.WriteString(logfmtValue(value))
+		}
+	}
+	if logOutput.json {
+		line.WriteByte('}')
+	}
+	line.WriteByte('\n')
+
+	logOutput.w.Write(line.Bytes())
+}
+
+// logfmtValue formats a value, quoting it if it's empty or contains spaces, quotes or '='.
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// workerLogger returns a Logger carrying the fields that identify one of the shovel's workers.
+// With several sinks, sink_host and sink_vhost list each of them in order, separated by commas.
+func (s ShovelConfig) workerLogger(worker int) Logger {
+	sourceHost, sourceVHost := s.Source.endpoint()
+	sinkHosts := make([]string, len(s.Sinks))
+	sinkVHosts := make([]string, len(s.Sinks))
+	for i, sink := range s.Sinks {
+		sinkHosts[i], sinkVHosts[i] = sink.endpoint()
+	}
+	return logger.With(
+		"shovel", s.Name,
+		"worker", worker,
+		"source_host", sourceHost,
+		"source_vhost", sourceVHost,
+		"sink_host", strings.Join(sinkHosts, ","),
+		"sink_vhost", strings.Join(sinkVHosts, ","))
+}
@@ -3,59 +3,258 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
-	"sync"
+	"sort"
+	"syscall"
+	"time"
 )
 
+// configFiles returns the given files followed by every *.yaml file in dir, if set.
+func configFiles(files []string, dir string) ([]string, error) {
+	if dir == "" {
+		return files, nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return append(append([]string(nil), files...), matches...), nil
+}
+
+// loadShovels parses every ShovelConfig from each of the given files.
+// Default names are assigned in file order, so they are stable across reloads.
+func loadShovels(files []string) ([]ShovelConfig, error) {
+	numShovels = 0
+
+	var shovels []ShovelConfig
+	names := make(map[string]bool, len(files))
+	for _, f := range files {
+		reader, err := os.Open(f)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := ParseShovels(reader)
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+
+		for _, shovel := range parsed {
+			if names[shovel.Name] {
+				return nil, fmt.Errorf("duplicate shovel name %q in %s", shovel.Name, f)
+			}
+			names[shovel.Name] = true
+		}
+		shovels = append(shovels, parsed...)
+	}
+	return shovels, nil
+}
+
+// modTimes returns the modification time of each file, or the zero time if it can't be read.
+func modTimes(files []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			times[f] = info.ModTime()
+		} else {
+			times[f] = time.Time{}
+		}
+	}
+	return times
+}
+
+// changedFile returns a file that was added, removed or modified between two calls to modTimes.
+func changedFile(before, after map[string]time.Time) (string, bool) {
+	for f, t := range after {
+		if old, ok := before[f]; !ok || !old.Equal(t) {
+			return f, true
+		}
+	}
+	for f := range before {
+		if _, ok := after[f]; !ok {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// validateCommand checks config files without connecting to any broker,
+// exiting non-zero if any of them has problems.
+func validateCommand(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configDir := flags.String("config-dir", "", "also validate every *.yaml file in this directory")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s validate: [-config-dir dir] filenames..\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	files, err := configFiles(flags.Args(), *configDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(files) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, f := range files {
+		if _, err := loadShovels([]string{f}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+
+	// names must also be unique across files
+	shovels, err := loadShovels(files)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(len(shovels), "shovels in", len(files), "files OK")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validateCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		ctlCommand(os.Args[2:])
+		return
+	}
+
 	threads := flag.Int("threads", runtime.NumCPU(), "set GOMAXPROCS")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "time to wait for outstanding publishes to be confirmed on shutdown")
+	configDir := flag.String("config-dir", "", "also load every *.yaml file in this directory")
+	listen := flag.String("listen", "", "serve /metrics, /healthz and /readyz on this address, e.g. :9090")
+	adminAddr := flag.String("admin", "", "serve the admin API on this address, or on a Unix socket given as unix:/path")
+	unhealthyAfter := flag.Duration("unhealthy-after", 5*time.Minute, "report unhealthy once a worker has been disconnected this long")
+	logFormat := flag.String("log-format", "logfmt", "log output format, logfmt or json")
+	logLevel := flag.String("log-level", "info", "minimum level to log: debug, info, warn or error")
+	pollInterval := flag.Duration("poll", 0, "reload config files when they change, checking at this interval (0 to only reload on SIGHUP)")
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s: filenames..\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage of %s: [-config-dir dir] filenames..\n       %s validate [-config-dir dir] filenames..\n       %s ctl [-admin addr] command..\n", os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
+	if err := configureLogging(*logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	runtime.GOMAXPROCS(*threads)
 
-	files := flag.Args()
+	files, err := configFiles(flag.Args(), *configDir)
+	if err != nil {
+		logger.Fatal("cannot list config files", "error", err)
+	}
 	if len(files) == 0 {
-		log.Fatal("no config files specified")
+		logger.Error("no config files specified")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	shovels := make([]ShovelConfig, len(files))
-	for i, f := range files {
-		reader, err := os.Open(f)
+	shovels, err := loadShovels(files)
+	if err != nil {
+		logger.Fatal("invalid config", "error", err)
+	}
+	lastModified := modTimes(files)
+
+	manager := &Manager{DrainTimeout: *drainTimeout}
+	reloads := make(chan chan error)
+
+	if *adminAddr != "" {
+		listener, err := openListener(*adminAddr)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal("cannot serve admin API", "error", err)
 		}
-		shovels[i] = ParseShovel(reader)
+		go func() {
+			logger.Fatal("admin server failed", "error", http.Serve(listener, adminHandler(manager, reloads)))
+		}()
 	}
+	manager.Apply(shovels)
 
-	var wg sync.WaitGroup
-
-	for _, shovel := range shovels {
-		log.Println("initializing", shovel.Name)
+	// only listen once the workers are registered, so /readyz can't report ready without them
+	if *listen != "" {
+		http.Handle("/metrics", metrics)
+		http.Handle("/healthz", healthHandler(metrics, *unhealthyAfter))
+		http.Handle("/readyz", readyHandler(metrics))
+		go func() {
+			logger.Fatal("metrics server failed", "error", http.ListenAndServe(*listen, nil))
+		}()
+	}
 
-		for i := 0; i < shovel.Concurrency; i++ {
-			worker := Worker{ShovelConfig: shovel}
-			worker.Name = fmt.Sprintf("%s [%d]", worker.Name, i+1)
-			worker.Init()
+	logger.Info("workers started")
 
-			go func() {
-				defer log.Println("worker", worker.Name, "done")
-				defer wg.Done()
-				worker.Work()
-			}()
+	reload := func() error {
+		files, err := configFiles(flag.Args(), *configDir)
+		if err != nil {
+			logger.Error("not reloading", "error", err)
+			return err
+		}
+		lastModified = modTimes(files)
 
-			wg.Add(1)
+		shovels, err := loadShovels(files)
+		if err != nil {
+			logger.Error("not reloading", "error", err)
+			return err
 		}
+		manager.Apply(shovels)
+		logger.Info("reloaded config", "shovels", len(shovels))
+		return nil
+	}
+
+	var poll <-chan time.Time
+	if *pollInterval > 0 {
+		poll = time.NewTicker(*pollInterval).C
 	}
 
-	log.Println("workers are up and running")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-poll:
+			files, err := configFiles(flag.Args(), *configDir)
+			if err != nil {
+				logger.Error("not polling", "error", err)
+				continue
+			}
+			if f, changed := changedFile(lastModified, modTimes(files)); changed {
+				logger.Info("config changed", "file", f)
+				reload()
+			}
 
-	wg.Wait()
+		case reply := <-reloads:
+			logger.Info("reloading config", "reason", "admin API")
+			reply <- reload()
+
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				logger.Info("reloading config", "reason", sig.String())
+				reload()
+				continue
+			}
+
+			// stop on the first signal; a second one kills the process immediately
+			signal.Stop(signals)
+			logger.Info("draining workers", "reason", sig.String())
+			manager.Stop()
+			return
+		}
+	}
 }
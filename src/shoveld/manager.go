@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errUnknownShovel = errors.New("no such shovel")
+	errUnknownWorker = errors.New("no such worker")
+	errUnknownAction = errors.New("action must be pause, resume or restart")
+)
+
+// runningShovel tracks the workers started for a single ShovelConfig.
+type runningShovel struct {
+	config  ShovelConfig
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	workers []*Worker
+}
+
+// Manager starts and stops shovels as the set of configurations changes.
+// m guards shovels, and is not held while waiting for shovels to stop so
+// Status and Control stay responsive during a reload; applying serializes Apply.
+type Manager struct {
+	DrainTimeout time.Duration
+	applying     sync.Mutex
+	m            sync.Mutex
+	shovels      map[string]*runningShovel
+}
+
+// Apply makes the running shovels match configs, identified by name.
+// Shovels that were removed or whose config changed are drained and stopped before any are (re)started;
+// unchanged shovels keep running untouched.
+func (m *Manager) Apply(configs []ShovelConfig) {
+	m.applying.Lock()
+	defer m.applying.Unlock()
+
+	wanted := make(map[string]ShovelConfig, len(configs))
+	for _, config := range configs {
+		wanted[config.Name] = config
+	}
+
+	m.m.Lock()
+	if m.shovels == nil {
+		m.shovels = make(map[string]*runningShovel)
+	}
+	var stopping []*runningShovel
+	for name, running := range m.shovels {
+		if config, ok := wanted[name]; !ok || !reflect.DeepEqual(config, running.config) {
+			logger.Info("stopping shovel", "shovel", name)
+			close(running.stop)
+			metrics.remove(name)
+			stopping = append(stopping, running)
+			delete(m.shovels, name)
+		}
+	}
+	m.m.Unlock()
+
+	for _, running := range stopping {
+		running.wg.Wait()
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	for _, config := range configs {
+		if _, ok := m.shovels[config.Name]; !ok {
+			m.shovels[config.Name] = m.start(config)
+		}
+	}
+}
+
+// Stop drains and stops every running shovel.
+func (m *Manager) Stop() {
+	m.Apply(nil)
+}
+
+func (m *Manager) start(shovel ShovelConfig) *runningShovel {
+	logger.Info("starting shovel", "shovel", shovel.Name)
+
+	running := &runningShovel{config: shovel, stop: make(chan struct{})}
+	for i := 0; i < shovel.Concurrency; i++ {
+		worker := Worker{
+			ShovelConfig: shovel,
+			DrainTimeout: m.DrainTimeout,
+			metrics:      metrics.worker(shovel.Name, i+1, shovel.Source.queueNames()),
+			log:          shovel.workerLogger(i + 1),
+			nudge:        make(chan struct{}, 1)}
+		worker.Name = fmt.Sprintf("%s [%d]", worker.Name, i+1)
+		running.workers = append(running.workers, &worker)
+
+		running.wg.Add(1)
+		go func() {
+			defer worker.log.Info("done")
+			defer running.wg.Done()
+			worker.Work(running.stop)
+		}()
+	}
+	return running
+}
+
+// WorkerStatus describes a worker's state and counters.
+type WorkerStatus struct {
+	Worker       int    `json:"worker"`
+	State        string `json:"state"`
+	Consumed     uint64 `json:"consumed"`
+	Published    uint64 `json:"published"`
+	Acked        uint64 `json:"acked"`
+	Nacked       uint64 `json:"nacked"`
+	Republished  uint64 `json:"republished"`
+	Dropped      uint64 `json:"dropped"`
+	Filtered     uint64 `json:"filtered"`
+	Retried      uint64 `json:"retried"`
+	DeadLettered uint64 `json:"dead_lettered"`
+	Returned     uint64 `json:"returned"`
+	Failed       uint64 `json:"transform_failed"`
+	Reconnects   uint64 `json:"reconnects"`
+	Inflight     int64  `json:"inflight"`
+}
+
+// ShovelStatus describes a running shovel, with credentials removed from its config.
+type ShovelStatus struct {
+	Name    string         `json:"name"`
+	Config  interface{}    `json:"config"`
+	Workers []WorkerStatus `json:"workers"`
+}
+
+// Status returns the status of every running shovel, sorted by name.
+func (m *Manager) Status() []ShovelStatus {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	names := make([]string, 0, len(m.shovels))
+	for name := range m.shovels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statuses := make([]ShovelStatus, len(names))
+	for i, name := range names {
+		running := m.shovels[name]
+		statuses[i] = ShovelStatus{Name: name, Config: redactedConfig(running.config)}
+		for j, worker := range running.workers {
+			statuses[i].Workers = append(statuses[i].Workers, WorkerStatus{
+				Worker:       j + 1,
+				State:        stateNames[worker.metrics.getState()],
+				Consumed:     atomic.LoadUint64(&worker.metrics.consumed),
+				Published:    atomic.LoadUint64(&worker.metrics.published),
+				Acked:        atomic.LoadUint64(&worker.metrics.acked),
+				Nacked:       atomic.LoadUint64(&worker.metrics.nacked),
+				Republished:  atomic.LoadUint64(&worker.metrics.republished),
+				Dropped:      atomic.LoadUint64(&worker.metrics.dropped),
+				Filtered:     atomic.LoadUint64(&worker.metrics.filtered),
+				Retried:      atomic.LoadUint64(&worker.metrics.retried),
+				DeadLettered: atomic.LoadUint64(&worker.metrics.deadLettered),
+				Returned:     atomic.LoadUint64(&worker.metrics.returned),
+				Failed:       atomic.LoadUint64(&worker.metrics.failed),
+				Reconnects:   atomic.LoadUint64(&worker.metrics.reconnects),
+				Inflight:     atomic.LoadInt64(&worker.metrics.inflight)})
+		}
+	}
+	return statuses
+}
+
+// Control pauses, resumes or restarts the workers of a shovel.
+// If worker is 0 the action applies to all of them, otherwise just to the worker with that index.
+func (m *Manager) Control(name string, worker int, action string) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	running, ok := m.shovels[name]
+	if !ok {
+		return errUnknownShovel
+	}
+	if worker < 0 || worker > len(running.workers) {
+		return errUnknownWorker
+	}
+
+	workers := running.workers
+	if worker > 0 {
+		workers = workers[worker-1 : worker]
+	}
+
+	for _, w := range workers {
+		switch action {
+		case "pause":
+			w.Pause()
+		case "resume":
+			w.Resume()
+		case "restart":
+			w.Restart()
+		default:
+			return errUnknownAction
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the publish-to-confirm latency histogram.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// workerMetrics holds the counters and connection status for a single worker.
+// They are updated atomically so the worker never blocks on a scrape.
+type workerMetrics struct {
+	consumed     uint64
+	published    uint64
+	acked        uint64
+	nacked       uint64
+	republished  uint64
+	dropped      uint64
+	filtered     uint64
+	retried      uint64
+	deadLettered uint64
+	returned     uint64
+	failed       uint64
+	reconnects   uint64
+	inflight     int64
+
+	// disconnectedAt is when the worker lost its consumer, in Unix nanoseconds, or 0 while consuming
+	disconnectedAt int64
+	state          int32
+
+	m       sync.Mutex
+	buckets []uint64
+	count   uint64
+	sum     float64
+
+	queues []*queueMetrics // in the order of the shovel's source queues
+}
+
+// queueMetrics holds the counters for one of a worker's source queues.
+type queueMetrics struct {
+	queue    string
+	consumed uint64
+	acked    uint64
+	nacked   uint64
+}
+
+func newWorkerMetrics(queues []string) *workerMetrics {
+	m := &workerMetrics{
+		buckets:        make([]uint64, len(latencyBuckets)),
+		disconnectedAt: time.Now().UnixNano()}
+	for _, queue := range queues {
+		m.queues = append(m.queues, &queueMetrics{queue: queue})
+	}
+	return m
+}
+
+// setConsuming records whether the worker currently has an open consumer.
+func (m *workerMetrics) setConsuming(consuming bool) {
+	if consuming {
+		atomic.StoreInt64(&m.disconnectedAt, 0)
+	} else {
+		atomic.CompareAndSwapInt64(&m.disconnectedAt, 0, time.Now().UnixNano())
+	}
+}
+
+// disconnected returns how long the worker has been without a consumer, or 0 while consuming.
+func (m *workerMetrics) disconnected() time.Duration {
+	at := atomic.LoadInt64(&m.disconnectedAt)
+	if at == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, at))
+}
+
+// observeLatency records how long a publish took to be confirmed.
+func (m *workerMetrics) observeLatency(d time.Duration) {
+	seconds := d.Seconds()
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			m.buckets[i]++
+		}
+	}
+	m.count++
+	m.sum += seconds
+}
+
+// Worker states reported by the admin API.
+const (
+	stateConnecting int32 = iota
+	stateRunning
+	statePaused
+)
+
+var stateNames = []string{"connecting", "running", "paused"}
+
+func (m *workerMetrics) setState(state int32) {
+	atomic.StoreInt32(&m.state, state)
+}
+
+func (m *workerMetrics) getState() int32 {
+	return atomic.LoadInt32(&m.state)
+}
+
+// workerKey identifies a worker by shovel name and index, counting from 1.
+type workerKey struct {
+	shovel string
+	worker int
+}
+
+type workerKeys []workerKey
+
+func (k workerKeys) Len() int      { return len(k) }
+func (k workerKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k workerKeys) Less(i, j int) bool {
+	if k[i].shovel != k[j].shovel {
+		return k[i].shovel < k[j].shovel
+	}
+	return k[i].worker < k[j].worker
+}
+
+// metricsRegistry tracks the metrics of every running worker and serves them in the Prometheus text format.
+type metricsRegistry struct {
+	m       sync.Mutex
+	workers map[workerKey]*workerMetrics
+}
+
+// metrics is the registry used by all workers.
+var metrics = &metricsRegistry{workers: make(map[workerKey]*workerMetrics)}
+
+// worker returns the metrics for a worker consuming the given queues, creating them if needed.
+func (r *metricsRegistry) worker(shovel string, worker int, queues []string) *workerMetrics {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	key := workerKey{shovel, worker}
+	if r.workers[key] == nil {
+		r.workers[key] = newWorkerMetrics(queues)
+	}
+	return r.workers[key]
+}
+
+// remove forgets the metrics of every worker of a shovel.
+func (r *metricsRegistry) remove(shovel string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for key := range r.workers {
+		if key.shovel == shovel {
+			delete(r.workers, key)
+		}
+	}
+}
+
+var counterMetrics = []struct {
+	name  string
+	help  string
+	value func(*workerMetrics) *uint64
+}{
+	{"shoveld_consumed_total", "Messages received from the source.", func(m *workerMetrics) *uint64 { return &m.consumed }},
+	{"shoveld_published_total", "Messages published, counted once per sink.", func(m *workerMetrics) *uint64 { return &m.published }},
+	{"shoveld_acked_total", "Messages confirmed by every sink and acked on the source.", func(m *workerMetrics) *uint64 { return &m.acked }},
+	{"shoveld_nacked_total", "Messages rejected by a sink, and requeued, retried or dead-lettered.", func(m *workerMetrics) *uint64 { return &m.nacked }},
+	{"shoveld_republished_total", "Publishes of messages redelivered by the source.", func(m *workerMetrics) *uint64 { return &m.republished }},
+	{"shoveld_dropped_total", "Messages acked on the source because transforms dropped them or no sink matched.", func(m *workerMetrics) *uint64 { return &m.dropped }},
+	{"shoveld_filtered_total", "Messages that did not match the shovel's filter.", func(m *workerMetrics) *uint64 { return &m.filtered }},
+	{"shoveld_retried_total", "Messages rejected by a sink and republished to the source queue to retry.", func(m *workerMetrics) *uint64 { return &m.retried }},
+	{"shoveld_dead_lettered_total", "Messages rejected too often and published to the dead-letter exchange.", func(m *workerMetrics) *uint64 { return &m.deadLettered }},
+	{"shoveld_returned_total", "Messages a sink returned as unroutable.", func(m *workerMetrics) *uint64 { return &m.returned }},
+	{"shoveld_transform_failed_total", "Messages rejected on the source because a transform failed.", func(m *workerMetrics) *uint64 { return &m.failed }},
+	{"shoveld_reconnects_total", "Times the worker reconnected after losing a connection.", func(m *workerMetrics) *uint64 { return &m.reconnects }},
+}
+
+var queueCounterMetrics = []struct {
+	name  string
+	help  string
+	value func(*queueMetrics) *uint64
+}{
+	{"shoveld_queue_consumed_total", "Messages received from each source queue.", func(m *queueMetrics) *uint64 { return &m.consumed }},
+	{"shoveld_queue_acked_total", "Messages from each source queue confirmed by every sink and acked.", func(m *queueMetrics) *uint64 { return &m.acked }},
+	{"shoveld_queue_nacked_total", "Messages from each source queue rejected or returned by a sink, and requeued, retried or dead-lettered.", func(m *queueMetrics) *uint64 { return &m.nacked }},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// snapshot returns the registered workers, sorted by shovel and index.
+func (r *metricsRegistry) snapshot() ([]workerKey, map[workerKey]*workerMetrics) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	keys := make([]workerKey, 0, len(r.workers))
+	workers := make(map[workerKey]*workerMetrics, len(r.workers))
+	for key, m := range r.workers {
+		keys = append(keys, key)
+		workers[key] = m
+	}
+	sort.Sort(workerKeys(keys))
+	return keys, workers
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	keys, workers := r.snapshot()
+
+	labels := func(key workerKey) string {
+		return fmt.Sprintf(`shovel="%s",worker="%d"`, labelEscaper.Replace(key.shovel), key.worker)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, counter := range counterMetrics {
+		header(w, counter.name, counter.help, "counter")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s{%s} %d\n", counter.name, labels(key), atomic.LoadUint64(counter.value(workers[key])))
+		}
+	}
+
+	for _, counter := range queueCounterMetrics {
+		header(w, counter.name, counter.help, "counter")
+		for _, key := range keys {
+			for _, queue := range workers[key].queues {
+				fmt.Fprintf(w, "%s{%s,queue=\"%s\"} %d\n", counter.name, labels(key), labelEscaper.Replace(queue.queue),
+					atomic.LoadUint64(counter.value(queue)))
+			}
+		}
+	}
+
+	header(w, "shoveld_consuming", "Whether the worker has an open consumer on the source.", "gauge")
+	for _, key := range keys {
+		consuming := 0
+		if workers[key].disconnected() == 0 {
+			consuming = 1
+		}
+		fmt.Fprintf(w, "shoveld_consuming{%s} %d\n", labels(key), consuming)
+	}
+
+	header(w, "shoveld_inflight", "Publishes awaiting confirmation from the sink.", "gauge")
+	for _, key := range keys {
+		fmt.Fprintf(w, "shoveld_inflight{%s} %d\n", labels(key), atomic.LoadInt64(&workers[key].inflight))
+	}
+
+	const latency = "shoveld_confirm_latency_seconds"
+	header(w, latency, "Time from publishing to the sink until it confirmed.", "histogram")
+	for _, key := range keys {
+		m := workers[key]
+		m.m.Lock()
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", latency, labels(key), bound, m.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", latency, labels(key), m.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", latency, labels(key), m.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", latency, labels(key), m.count)
+		m.m.Unlock()
+	}
+}
+
+func header(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"text/template"
+
+	"github.com/streadway/amqp"
+)
+
+// ShovelRoutingKey rewrites a message's routing key. The steps are applied in order:
+// Template, a text/template such as "{{.Exchange}}.{{.RoutingKey}}", replaces the key;
+// Match, a regular expression, rewrites the key to Replace, which may refer to capture
+// groups as $1, if it matches; and finally Prefix and Suffix are added.
+type ShovelRoutingKey struct {
+	Template string
+	Match    string
+	Replace  string
+	Prefix   string
+	Suffix   string
+}
+
+// routingKeyData is available to routing key templates.
+type routingKeyData struct {
+	RoutingKey string
+	Exchange   string
+	Headers    amqp.Table
+}
+
+// Header returns a header's value as a string, or "" if it's missing.
+func (d routingKeyData) Header(name string) string {
+	if value, ok := d.Headers[name]; ok {
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+func (r ShovelRoutingKey) compile() (transformStep, error) {
+	var tmpl *template.Template
+	if r.Template != "" {
+		var err error
+		if tmpl, err = template.New("routing key").Parse(r.Template); err != nil {
+			return nil, err
+		}
+	}
+
+	var match *regexp.Regexp
+	if r.Match != "" {
+		var err error
+		if match, err = regexp.Compile(r.Match); err != nil {
+			return nil, err
+		}
+	} else if r.Replace != "" {
+		return nil, fmt.Errorf("replace requires match")
+	}
+
+	return func(m *message) (bool, error) {
+		key := m.routingKey
+
+		if tmpl != nil {
+			var out bytes.Buffer
+			data := routingKeyData{RoutingKey: key, Exchange: m.delivery.Exchange, Headers: m.Headers}
+			if err := tmpl.Execute(&out, data); err != nil {
+				return false, err
+			}
+			key = out.String()
+		}
+
+		if match != nil && match.MatchString(key) {
+			key = match.ReplaceAllString(key, r.Replace)
+		}
+
+		m.routingKey = r.Prefix + key + r.Suffix
+		return true, nil
+	}, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRoutingKeyTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		headers  amqp.Table
+		want     string // empty if the template fails
+	}{
+		{`{{.Exchange}}.{{.RoutingKey}}`, nil, "in.orders.created"},
+		{`{{.Header "x-dc"}}.{{.RoutingKey}}`, amqp.Table{"x-dc": "us"}, "us.orders.created"},
+		{`{{.Header "x-dc"}}.{{.RoutingKey}}`, nil, ".orders.created"},
+		{`{{index .Headers "x-route" "region"}}`, amqp.Table{"x-route": amqp.Table{"region": "eu"}}, "eu"},
+		{`{{index .Headers "x-route" "region"}}`, nil, ""},
+		{`{{index .Headers "x-route" "region"}}`, amqp.Table{"x-route": "eu"}, ""},
+	}
+
+	for _, test := range tests {
+		step, err := ShovelRoutingKey{Template: test.template, Prefix: "p."}.compile()
+		if err != nil {
+			t.Fatalf("%s: %v", test.template, err)
+		}
+		m := newMessage(amqp.Delivery{Exchange: "in", Headers: test.headers}, "orders.created")
+		keep, err := step(m)
+
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("%s with %v: routing key %q, want an error", test.template, test.headers, m.routingKey)
+		case test.want == "" && (keep || m.routingKey != "orders.created"):
+			t.Errorf("%s with %v: failed but kept the message as %q", test.template, test.headers, m.routingKey)
+		case test.want != "" && (err != nil || !keep || m.routingKey != "p."+test.want):
+			t.Errorf("%s with %v: %q, %v, %v, want %q", test.template, test.headers, m.routingKey, keep, err, "p."+test.want)
+		}
+	}
+}
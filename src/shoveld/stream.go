@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Values of ShovelQueue.Type.
+const (
+	queueClassic = "classic"
+	queueQuorum  = "quorum"
+	queueStream  = "stream"
+)
+
+// declare returns the queue's declare settings, with x-queue-type added if Type is set.
+func (q ShovelQueue) declare() *ShovelDeclare {
+	if q.Type == "" {
+		return q.Declare
+	}
+
+	var declare ShovelDeclare
+	if q.Declare != nil {
+		declare = *q.Declare
+	}
+	declare.Arguments = map[string]interface{}{"x-queue-type": q.Type}
+	if q.Declare != nil {
+		for key, value := range q.Declare.Arguments {
+			declare.Arguments[key] = value
+		}
+	}
+	return &declare
+}
+
+// streamOffset converts a stream Offset into the value of the x-stream-offset consumer argument:
+// first, last or next, a numeric offset, or an RFC 3339 timestamp.
+func streamOffset(offset string) (interface{}, error) {
+	switch offset {
+	case "first", "last", "next":
+		return offset, nil
+	}
+	if n, err := strconv.ParseInt(offset, 10, 64); err == nil {
+		if n < 0 {
+			return nil, fmt.Errorf("must not be negative")
+		}
+		return n, nil
+	}
+	if t, err := time.Parse(time.RFC3339, offset); err == nil {
+		return t, nil
+	}
+	return nil, fmt.Errorf("must be first, last, next, an offset or an RFC 3339 timestamp")
+}
+
+// streamPosition tracks how far a worker got through a stream, so it can carry on from there
+// after reconnecting instead of starting from the configured offset again. Streams keep their
+// messages, so the position is the oldest delivery that has not been acked or nacked
+// without requeueing, or else the one after the newest delivery.
+type streamPosition struct {
+	m           sync.Mutex
+	outstanding map[int64]bool
+	next        int64
+	started     bool
+}
+
+func newStreamPosition() *streamPosition {
+	return &streamPosition{outstanding: map[int64]bool{}}
+}
+
+// resume returns the offset to start consuming from, and false if nothing has been consumed yet.
+// On a new channel that is the oldest outstanding delivery, and deliveries outstanding from the
+// old channel are forgotten, since they will be delivered again. On the same channel, after a
+// pause, they are still being published and will be settled, so consuming carries on after them.
+func (p *streamPosition) resume(reconnected bool) (int64, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if !reconnected {
+		return p.next, p.started
+	}
+
+	offset := p.next
+	for o := range p.outstanding {
+		if o < offset {
+			offset = o
+		}
+	}
+	p.outstanding = map[int64]bool{}
+	p.next = offset
+	return offset, p.started
+}
+
+// track records a delivery, returning it with an Acknowledger that updates the position.
+// Deliveries without an x-stream-offset header are returned unchanged.
+func (p *streamPosition) track(msg amqp.Delivery) amqp.Delivery {
+	offset, ok := msg.Headers["x-stream-offset"].(int64)
+	if !ok {
+		return msg
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.started = true
+	p.outstanding[offset] = true
+	if offset >= p.next {
+		p.next = offset + 1
+	}
+	msg.Acknowledger = streamAcknowledger{msg.Acknowledger, p, offset}
+	return msg
+}
+
+func (p *streamPosition) done(offset int64) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	delete(p.outstanding, offset)
+}
+
+// streamAcknowledger updates a streamPosition as deliveries are acked or nacked.
+type streamAcknowledger struct {
+	amqp.Acknowledger
+	position *streamPosition
+	offset   int64
+}
+
+func (a streamAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.position.done(a.offset)
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a streamAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if !requeue {
+		a.position.done(a.offset)
+	}
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a streamAcknowledger) Reject(tag uint64, requeue bool) error {
+	if !requeue {
+		a.position.done(a.offset)
+	}
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+// consumeArgs returns the consumer arguments for a source queue, starting a stream where
+// the worker left off, or at the configured offset the first time. reconnected is set for
+// the first consumer on a new source channel.
+func (w *Worker) consumeArgs(queue int, reconnected bool) amqp.Table {
+	config := w.Source.Queues[queue]
+	if config.Type != queueStream {
+		return nil
+	}
+
+	if offset, ok := w.streams[queue].resume(reconnected); ok {
+		return amqp.Table{"x-stream-offset": offset}
+	}
+	if config.Offset == "" {
+		return nil
+	}
+	offset, _ := streamOffset(config.Offset)
+	return amqp.Table{"x-stream-offset": offset}
+}
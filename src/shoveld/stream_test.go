@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestStreamPositionResume(t *testing.T) {
+	p := newStreamPosition()
+	if _, started := p.resume(true); started {
+		t.Fatal("started before consuming anything")
+	}
+
+	source := newFakeChannel(t, "source channel")
+	var deliveries []amqp.Delivery
+	for offset := int64(10); offset < 15; offset++ {
+		msg := source.deliver("m")
+		msg.Headers = amqp.Table{"x-stream-offset": offset}
+		deliveries = append(deliveries, p.track(msg))
+	}
+	deliveries[0].Ack(false)
+	deliveries[2].Ack(false)
+	deliveries[3].Nack(false, false)
+
+	// pausing keeps the channel, and 11 and 14 are still being published, so consuming carries on after 14
+	if offset, started := p.resume(false); offset != 15 || !started {
+		t.Errorf("resume on the same channel = %d, %v, want 15", offset, started)
+	}
+	deliveries[1].Ack(false)
+
+	// on a new channel, 14 was never settled and is consumed again
+	if offset, _ := p.resume(true); offset != 14 {
+		t.Errorf("resume on a new channel = %d, want 14", offset)
+	}
+	if offset, _ := p.resume(true); offset != 14 {
+		t.Errorf("second resume on a new channel = %d, want 14", offset)
+	}
+
+	// requeueing doesn't settle a delivery, since streams keep their messages
+	msg := source.deliver("m")
+	msg.Headers = amqp.Table{"x-stream-offset": int64(14)}
+	p.track(msg).Nack(false, true)
+	if offset, _ := p.resume(true); offset != 14 {
+		t.Errorf("resume after a requeue = %d, want 14", offset)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPKI is a locally generated CA with a server and a client certificate, written out as PEM files.
+type testPKI struct {
+	dir        string
+	ca         *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	caFile     string
+	serverCert tls.Certificate
+	clientCert string
+	clientKey  string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	dir, err := ioutil.TempDir("", "shoveld-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPKI{dir: dir}
+
+	p.caKey, p.ca = p.issue(t, "test CA", nil, nil)
+	p.caFile = p.write(t, "ca.pem", "CERTIFICATE", p.ca.Raw)
+
+	serverKey, server := p.issue(t, "broker", p.ca, p.caKey)
+	p.serverCert = tls.Certificate{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}
+
+	clientKey, client := p.issue(t, "shoveld", p.ca, p.caKey)
+	p.clientCert = p.write(t, "client.pem", "CERTIFICATE", client.Raw)
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.clientKey = p.write(t, "client-key.pem", "EC PRIVATE KEY", der)
+	return p
+}
+
+func (p *testPKI) close() {
+	os.RemoveAll(p.dir)
+}
+
+// issue creates a key and a certificate for name signed by parent, or a self-signed CA if parent is nil.
+func (p *testPKI) issue(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.IPAddresses = nil
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func (p *testPKI) write(t *testing.T, name, kind string, der []byte) string {
+	filename := filepath.Join(p.dir, name)
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestTLSConfig(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.close()
+
+	other := newTestPKI(t)
+	defer other.close()
+	empty := filepath.Join(pki.dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("not a certificate\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		tls  AMQPTLS
+		err  string
+	}{
+		{"system roots", AMQPTLS{}, ""},
+		{"ca", AMQPTLS{CA: pki.caFile, ServerName: "broker"}, ""},
+		{"client certificate", AMQPTLS{CA: pki.caFile, Cert: pki.clientCert, Key: pki.clientKey}, ""},
+		{"missing ca", AMQPTLS{CA: filepath.Join(pki.dir, "missing.pem")}, "no such file"},
+		{"ca without certificates", AMQPTLS{CA: empty}, "no certificates found in " + empty},
+		{"cert without key", AMQPTLS{Cert: pki.clientCert}, "cert and key must be set together"},
+		{"key without cert", AMQPTLS{Key: pki.clientKey}, "cert and key must be set together"},
+		{"mismatched key", AMQPTLS{Cert: pki.clientCert, Key: other.clientKey}, "private key does not match public key"},
+		{"key as cert", AMQPTLS{Cert: pki.clientKey, Key: pki.clientKey}, "failed to find"},
+	}
+
+	for _, test := range tests {
+		config, err := test.tls.Config()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if config.ServerName != test.tls.ServerName {
+			t.Errorf("%s: server name = %q, want %q", test.name, config.ServerName, test.tls.ServerName)
+		}
+		if (config.RootCAs != nil) != (test.tls.CA != "") {
+			t.Errorf("%s: root CAs set = %v", test.name, config.RootCAs != nil)
+		}
+		if len(config.Certificates) != 0 != (test.tls.Cert != "") {
+			t.Errorf("%s: %d client certificates", test.name, len(config.Certificates))
+		}
+	}
+}
+
+// login is what a client sent a fakeBroker in connection.start-ok.
+type login struct {
+	mechanism string
+	response  string
+	peer      string // common name of the client certificate, if any
+	err       error
+}
+
+// fakeBroker is an in-process amqps listener that offers mechanisms in connection.start,
+// reports the client's start-ok on logins, and hangs up.
+type fakeBroker struct {
+	listener   net.Listener
+	mechanisms string
+	logins     chan login
+}
+
+func newFakeBroker(t *testing.T, pki *testPKI, mechanisms string) *fakeBroker {
+	clients := x509.NewCertPool()
+	clients.AddCert(pki.ca)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pki.serverCert},
+		ClientCAs:    clients,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBroker{listener: listener, mechanisms: mechanisms, logins: make(chan login, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.logins <- b.serve(conn.(*tls.Conn))
+			conn.Close()
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) close() {
+	b.listener.Close()
+}
+
+// host returns the AMQPHost of a broker, which has no credentials or TLS settings yet.
+func (b *fakeBroker) host() AMQPHost {
+	addr := b.listener.Addr().(*net.TCPAddr)
+	return AMQPHost{Host: "127.0.0.1", Port: addr.Port, VHost: "/", User: "guest", Password: "guest", AuthMechanism: "PLAIN"}
+}
+
+func (b *fakeBroker) serve(conn *tls.Conn) login {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		return login{err: err}
+	}
+	var l login
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		l.peer = certs[0].Subject.CommonName
+	}
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return login{err: err}
+	}
+	if string(header) != "AMQP\x00\x00\x09\x01" {
+		return login{err: fmt.Errorf("protocol header %q", header)}
+	}
+
+	// connection.start: version 0-9, no server properties, mechanisms and locales
+	var start bytes.Buffer
+	start.Write([]byte{0, 10, 0, 10, 0, 9, 0, 0, 0, 0})
+	writeLongString(&start, b.mechanisms)
+	writeLongString(&start, "en_US")
+	frame := []byte{1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[3:], uint32(start.Len()))
+	frame = append(append(frame, start.Bytes()...), 0xCE)
+	if _, err := conn.Write(frame); err != nil {
+		return login{err: err}
+	}
+
+	// connection.start-ok: client properties, mechanism, response and locale
+	frame = make([]byte, 7)
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		return login{err: err}
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(frame[3:])+1)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return login{err: err}
+	}
+	r := bytes.NewReader(payload)
+	var method [2]uint16
+	var properties uint32
+	binary.Read(r, binary.BigEndian, &method)
+	binary.Read(r, binary.BigEndian, &properties)
+	r.Seek(int64(properties), 1)
+	if frame[0] != 1 || method != [2]uint16{10, 11} {
+		return login{err: errors.New("expected connection.start-ok")}
+	}
+	l.mechanism = readString(r, 1)
+	l.response = readString(r, 4)
+	return l
+}
+
+func writeLongString(w *bytes.Buffer, s string) {
+	binary.Write(w, binary.BigEndian, uint32(len(s)))
+	w.WriteString(s)
+}
+
+// readString reads a string prefixed by its length in size bytes.
+func readString(r *bytes.Reader, size int) string {
+	prefix := make([]byte, size)
+	r.Read(prefix)
+	var n uint64
+	for _, b := range prefix {
+		n = n<<8 | uint64(b)
+	}
+	s := make([]byte, n)
+	r.Read(s)
+	return string(s)
+}
+
+// expectLogin waits for the next login to a broker.
+func (b *fakeBroker) expectLogin(t *testing.T) login {
+	select {
+	case l := <-b.logins:
+		return l
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the client to log in")
+	}
+	return login{}
+}
+
+func TestDialTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.close()
+	broker := newFakeBroker(t, pki, "PLAIN AMQPLAIN")
+	defer broker.close()
+
+	host := broker.host()
+	host.TLS = &AMQPTLS{CA: pki.caFile, Cert: pki.clientCert, Key: pki.clientKey}
+	if uri := host.URIs()[0]; !strings.HasPrefix(uri, "amqps://") {
+		t.Fatalf("URI = %s, want the amqps scheme", uri)
+	}
+
+	// the fake broker hangs up after start-ok, which the client reports as a login failure
+	if _, err := host.Dial(); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	l := broker.expectLogin(t)
+	if l.err != nil {
+		t.Fatal(l.err)
+	}
+	if l.peer != "shoveld" || l.mechanism != "PLAIN" || l.response != "\x00guest\x00guest" {
+		t.Errorf("login = %+v, want PLAIN as guest with the shoveld certificate", l)
+	}
+}
+
+func TestDialTLSUntrustedBroker(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.close()
+	other := newTestPKI(t)
+	defer other.close()
+	broker := newFakeBroker(t, pki, "PLAIN")
+	defer broker.close()
+
+	tests := []struct {
+		name string
+		tls  AMQPTLS
+		err  string
+	}{
+		{"other CA", AMQPTLS{CA: other.caFile}, "certificate signed by unknown authority"},
+		{"wrong server name", AMQPTLS{CA: pki.caFile, ServerName: "elsewhere"}, "elsewhere"},
+	}
+	for _, test := range tests {
+		host := broker.host()
+		host.TLS = &test.tls
+		_, err := host.Dial()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+		}
+		if l := broker.expectLogin(t); l.err == nil {
+			t.Errorf("%s: broker got a login %+v", test.name, l)
+		}
+	}
+
+	// insecureskipverify is for development against brokers with self-signed certificates
+	host := broker.host()
+	host.TLS = &AMQPTLS{CA: other.caFile, InsecureSkipVerify: true}
+	host.Dial()
+	if l := broker.expectLogin(t); l.err != nil || l.mechanism != "PLAIN" {
+		t.Errorf("insecureskipverify: login = %+v", l)
+	}
+}
+
+func TestDialExternal(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.close()
+
+	tests := []struct {
+		offered   string
+		mechanism string
+		cert      bool
+		want      string // mechanism the client selects, or empty if it can't log in
+	}{
+		{"PLAIN EXTERNAL", "EXTERNAL", true, "EXTERNAL"},
+		{"EXTERNAL PLAIN", "external", true, "EXTERNAL"},
+		{"PLAIN", "EXTERNAL", true, ""},
+		{"PLAIN EXTERNAL", "PLAIN", true, "PLAIN"},
+	}
+	for _, test := range tests {
+		broker := newFakeBroker(t, pki, test.offered)
+		host := broker.host()
+		host.AuthMechanism = test.mechanism
+		host.TLS = &AMQPTLS{CA: pki.caFile, Cert: pki.clientCert, Key: pki.clientKey}
+		if problems := host.validate("sink"); len(problems) > 0 {
+			t.Errorf("%s offered %s: %v", test.mechanism, test.offered, problems)
+		}
+
+		_, err := host.Dial()
+		if test.want == "" {
+			// the client gives up after connection.start, without sending start-ok
+			broker.close()
+			if err == nil || !strings.Contains(err.Error(), "SASL") {
+				t.Errorf("%s offered %s: error = %v, want a SASL error", test.mechanism, test.offered, err)
+			}
+			continue
+		}
+		l := broker.expectLogin(t)
+		broker.close()
+		if l.err != nil {
+			t.Errorf("%s offered %s: %v", test.mechanism, test.offered, l.err)
+			continue
+		}
+		if l.mechanism != test.want || l.peer != "shoveld" {
+			t.Errorf("%s offered %s: login = %+v, want %s with the shoveld certificate", test.mechanism, test.offered, l, test.want)
+		}
+		if l.mechanism == "EXTERNAL" && l.response != "" {
+			t.Errorf("%s offered %s: EXTERNAL sent response %q, want none", test.mechanism, test.offered, l.response)
+		}
+	}
+
+	// EXTERNAL takes the identity from the client certificate, so one is required
+	host := AMQPHost{Host: "localhost", Port: 5671, AuthMechanism: "EXTERNAL", TLS: &AMQPTLS{CA: pki.caFile}}
+	problems := host.validate("sink")
+	if len(problems) != 1 || problems[0].String() != "sink.tls.cert: required for EXTERNAL authentication" {
+		t.Errorf("EXTERNAL without a certificate: %v", problems)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// ShovelDeclare controls how a queue or exchange is declared.
+// Passive only checks that it already exists, leaving its settings alone.
+// Otherwise it is declared durable unless Transient is set, and Exclusive applies to queues only.
+// Arguments are its x-arguments, such as x-queue-type or x-message-ttl.
+type ShovelDeclare struct {
+	Passive    bool
+	Transient  bool
+	AutoDelete bool
+	Exclusive  bool
+	Arguments  map[string]interface{}
+}
+
+// declareQueue declares a queue using d, or the defaults if d is nil.
+func (d *ShovelDeclare) declareQueue(channel *amqp.Channel, name string) error {
+	args, err := d.arguments()
+	if err != nil {
+		return err
+	}
+
+	var settings ShovelDeclare
+	if d != nil {
+		settings = *d
+	}
+	if settings.Passive {
+		_, err = channel.QueueDeclarePassive(name, !settings.Transient, settings.AutoDelete, settings.Exclusive, false, args)
+	} else {
+		_, err = channel.QueueDeclare(name, !settings.Transient, settings.AutoDelete, settings.Exclusive, false, args)
+	}
+	return err
+}
+
+// declareExchange declares an exchange of the given kind using d, or the defaults if d is nil.
+func (d *ShovelDeclare) declareExchange(channel *amqp.Channel, name, kind string) error {
+	args, err := d.arguments()
+	if err != nil {
+		return err
+	}
+
+	var settings ShovelDeclare
+	if d != nil {
+		settings = *d
+	}
+	if settings.Passive {
+		return channel.ExchangeDeclarePassive(name, kind, !settings.Transient, settings.AutoDelete, false, false, args)
+	}
+	return channel.ExchangeDeclare(name, kind, !settings.Transient, settings.AutoDelete, false, false, args)
+}
+
+// arguments returns the x-arguments as an amqp.Table.
+func (d *ShovelDeclare) arguments() (amqp.Table, error) {
+	if d == nil || d.Arguments == nil {
+		return nil, nil
+	}
+	return table(d.Arguments)
+}
+
+// table converts decoded YAML into an amqp.Table, since AMQP has no plain int or
+// map[interface{}]interface{} field types.
+func table(values map[string]interface{}) (amqp.Table, error) {
+	t := make(amqp.Table, len(values))
+	for key, value := range values {
+		converted, err := tableValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		t[key] = converted
+	}
+	return t, nil
+}
+
+func tableValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool, int64, float64, string:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if values[i], err = tableValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case map[interface{}]interface{}:
+		values := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			values[fmt.Sprint(key)] = item
+		}
+		return table(values)
+	}
+	return nil, fmt.Errorf("unsupported value %v", value)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// ShovelTransform is a single step of a shovel's transform pipeline, applied
+// between consuming and publishing. Exactly one of its fields should be set.
+type ShovelTransform struct {
+	SetHeaders        map[string]string
+	RemoveHeaders     []string
+	RenameHeaders     map[string]string
+	RoutingKey        string
+	RewriteRoutingKey *ShovelRoutingKey
+	Properties        *ShovelProperties
+	Drop              *ShovelMatch
+}
+
+// ShovelProperties overrides message properties; fields left empty are not changed.
+type ShovelProperties struct {
+	ContentType     string
+	ContentEncoding string
+	DeliveryMode    uint8
+	Priority        *uint8
+	CorrelationID   string
+	ReplyTo         string
+	Expiration      string
+	MessageID       string
+	Type            string
+	UserID          string
+	AppID           string
+}
+
+// message is a delivery on its way to the sink.
+type message struct {
+	amqp.Publishing
+	routingKey string
+	delivery   amqp.Delivery
+}
+
+// newMessage copies a delivery into the message that would be published to the sink.
+func newMessage(msg amqp.Delivery, routingKey string) *message {
+	return &message{
+		Publishing: amqp.Publishing{
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Headers:         msg.Headers,
+			Body:            msg.Body},
+		routingKey: routingKey,
+		delivery:   msg}
+}
+
+// setHeader sets a header, copying the headers first so the delivery's are left untouched.
+func (m *message) setHeader(key string, value interface{}) {
+	headers := make(amqp.Table, len(m.Headers)+1)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	if value == nil {
+		delete(headers, key)
+	} else {
+		headers[key] = value
+	}
+	m.Headers = headers
+}
+
+// transformStep applies one step of the pipeline to a message, returning false to drop it.
+// An error means the message can't be transformed and must not be published.
+type transformStep func(m *message) (bool, error)
+
+// compileTransforms turns the configured steps into a pipeline.
+func compileTransforms(transforms []ShovelTransform) ([]transformStep, error) {
+	steps := make([]transformStep, len(transforms))
+	for i, t := range transforms {
+		step, err := t.compile()
+		if err != nil {
+			return nil, fmt.Errorf("transforms[%d]: %v", i, err)
+		}
+		steps[i] = step
+	}
+	return steps, nil
+}
+
+// transform runs a message through the pipeline, returning false if a step dropped it.
+func transform(steps []transformStep, m *message) (bool, error) {
+	for _, step := range steps {
+		if keep, err := step(m); !keep || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (t ShovelTransform) compile() (transformStep, error) {
+	set := 0
+	for _, isSet := range []bool{t.SetHeaders != nil, t.RemoveHeaders != nil, t.RenameHeaders != nil,
+		t.RoutingKey != "", t.RewriteRoutingKey != nil, t.Properties != nil, t.Drop != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("exactly one of setheaders, removeheaders, renameheaders, routingkey, rewriteroutingkey, properties or drop must be set")
+	}
+
+	switch {
+	case t.SetHeaders != nil:
+		return func(m *message) (bool, error) {
+			for key, value := range t.SetHeaders {
+				m.setHeader(key, value)
+			}
+			return true, nil
+		}, nil
+
+	case t.RemoveHeaders != nil:
+		return func(m *message) (bool, error) {
+			for _, key := range t.RemoveHeaders {
+				if _, ok := m.Headers[key]; ok {
+					m.setHeader(key, nil)
+				}
+			}
+			return true, nil
+		}, nil
+
+	case t.RenameHeaders != nil:
+		return func(m *message) (bool, error) {
+			for from, to := range t.RenameHeaders {
+				if value, ok := m.Headers[from]; ok {
+					m.setHeader(from, nil)
+					m.setHeader(to, value)
+				}
+			}
+			return true, nil
+		}, nil
+
+	case t.RoutingKey != "":
+		return func(m *message) (bool, error) {
+			m.routingKey = t.RoutingKey
+			return true, nil
+		}, nil
+
+	case t.RewriteRoutingKey != nil:
+		return t.RewriteRoutingKey.compile()
+
+	case t.Properties != nil:
+		p := *t.Properties
+		return func(m *message) (bool, error) {
+			p.apply(&m.Publishing)
+			return true, nil
+		}, nil
+
+	default:
+		match := *t.Drop
+		if err := match.check(); err != nil {
+			return nil, fmt.Errorf("drop: %v", err)
+		}
+		return func(m *message) (bool, error) {
+			return !match.matches(m), nil
+		}, nil
+	}
+}
+
+func (p ShovelProperties) apply(msg *amqp.Publishing) {
+	override := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	override(&msg.ContentType, p.ContentType)
+	override(&msg.ContentEncoding, p.ContentEncoding)
+	override(&msg.CorrelationId, p.CorrelationID)
+	override(&msg.ReplyTo, p.ReplyTo)
+	override(&msg.Expiration, p.Expiration)
+	override(&msg.MessageId, p.MessageID)
+	override(&msg.Type, p.Type)
+	override(&msg.UserId, p.UserID)
+	override(&msg.AppId, p.AppID)
+	if p.DeliveryMode != 0 {
+		msg.DeliveryMode = p.DeliveryMode
+	}
+	if p.Priority != nil {
+		msg.Priority = *p.Priority
+	}
+}
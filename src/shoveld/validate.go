@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/streadway/amqp"
+	"gopkg.in/yaml.v2"
+)
+
+// FieldError is a single problem found in a shovel config.
+// Field is a path such as source.bindings[0].exchange and may be empty for problems with the whole document.
+type FieldError struct {
+	Shovel  string
+	Field   string
+	Message string
+}
+
+func (e FieldError) String() string {
+	s := e.Message
+	if e.Field != "" {
+		s = e.Field + ": " + s
+	}
+	if e.Shovel != "" {
+		s = "shovel " + e.Shovel + ": " + s
+	}
+	return s
+}
+
+// ConfigError lists every problem found while parsing shovel configs.
+type ConfigError []FieldError
+
+func (e ConfigError) Error() string {
+	if len(e) == 1 {
+		return e[0].String()
+	}
+
+	lines := make([]string, len(e))
+	for i, problem := range e {
+		lines[i] = "\t" + problem.String()
+	}
+	return fmt.Sprintf("%d problems:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+// validate checks that required fields are set and values are in range.
+func (s ShovelConfig) validate() []FieldError {
+	var problems []FieldError
+	check := func(ok bool, field, message string) {
+		if !ok {
+			problems = append(problems, FieldError{Field: field, Message: message})
+		}
+	}
+
+	check(s.Concurrency > 0, "concurrency", "must be positive")
+
+	problems = append(problems, s.Source.AMQPHost.validate("source")...)
+	if len(s.Source.Queues) == 0 {
+		problems = append(problems, s.Source.ShovelQueue.validate("source", s.Concurrency)...)
+	}
+	queues := make(map[string]bool, len(s.Source.Queues))
+	for i, queue := range s.Source.Queues {
+		prefix := fmt.Sprintf("source.queues[%d]", i)
+		problems = append(problems, queue.validate(prefix, s.Concurrency)...)
+		check(queue.Queue == "" || !queues[queue.Queue], prefix+".queue", "duplicate queue")
+		queues[queue.Queue] = true
+	}
+
+	if len(s.Sinks) == 0 {
+		problems = append(problems, s.Sink.validate("sink")...)
+	}
+	for i, sink := range s.Sinks {
+		problems = append(problems, sink.validate(fmt.Sprintf("sinks[%d]", i))...)
+	}
+	check(s.SinkMode == sinkModeFanout || s.SinkMode == sinkModeFirst, "sinkmode", "must be fanout or first")
+
+	for i, t := range s.Transforms {
+		if _, err := t.compile(); err != nil {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("transforms[%d]", i), Message: err.Error()})
+		}
+	}
+
+	if s.Filter != nil {
+		problems = append(problems, s.Filter.validate("filter")...)
+	}
+
+	if s.DeadLetter != nil {
+		check(s.DeadLetter.Exchange != "", "deadletter.exchange", "required")
+		check(s.DeadLetter.MaxAttempts > 0, "deadletter.maxattempts", "must be positive")
+	}
+	switch s.OnReturn {
+	case returnRequeue, returnDrop:
+	case returnDeadLetter:
+		check(s.DeadLetter != nil, "deadletter", "required when onreturn is deadletter")
+	default:
+		check(false, "onreturn", "must be requeue, deadletter or drop")
+	}
+
+	check(s.Reconnect.MinDelay > 0, "reconnect.mindelay", "must be positive")
+	check(s.Reconnect.MaxDelay >= s.Reconnect.MinDelay, "reconnect.maxdelay", "must be at least mindelay")
+	check(s.Reconnect.Factor >= 1, "reconnect.factor", "must be at least 1")
+	check(s.Reconnect.Jitter >= 0 && s.Reconnect.Jitter <= 1, "reconnect.jitter", "must be between 0 and 1")
+
+	return problems
+}
+
+// validate checks a single source queue consumed by the given number of workers.
+func (q ShovelQueue) validate(prefix string, concurrency int) []FieldError {
+	var problems []FieldError
+	if q.Queue == "" {
+		problems = append(problems, FieldError{Field: prefix + ".queue", Message: "required"})
+	}
+	if q.Prefetch <= 0 {
+		problems = append(problems, FieldError{Field: prefix + ".prefetch", Message: "must be positive"})
+	}
+	for i, binding := range q.Bindings {
+		if binding.Exchange == "" {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("%s.bindings[%d].exchange", prefix, i), Message: "required"})
+		}
+		if _, err := table(binding.Arguments); err != nil {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("%s.bindings[%d].arguments", prefix, i), Message: err.Error()})
+		}
+	}
+	if _, err := q.Declare.arguments(); err != nil {
+		problems = append(problems, FieldError{Field: prefix + ".declare.arguments", Message: err.Error()})
+	}
+	// each worker has its own connection, and only one of them could use an exclusive queue
+	if q.Declare != nil && q.Declare.Exclusive && concurrency > 1 {
+		problems = append(problems, FieldError{Field: prefix + ".declare.exclusive", Message: "requires concurrency 1"})
+	}
+
+	switch q.Type {
+	case "", queueClassic:
+	case queueQuorum, queueStream:
+		if q.Declare != nil && (q.Declare.Transient || q.Declare.AutoDelete || q.Declare.Exclusive) {
+			problems = append(problems, FieldError{Field: prefix + ".declare", Message: q.Type + " queues must be durable, and can't be autodelete or exclusive"})
+		}
+	default:
+		problems = append(problems, FieldError{Field: prefix + ".type", Message: "must be classic, quorum or stream"})
+	}
+	// every consumer of a stream receives all of its messages
+	if q.Type == queueStream && concurrency > 1 {
+		problems = append(problems, FieldError{Field: prefix + ".type", Message: "streams require concurrency 1"})
+	}
+	if q.Offset != "" {
+		if q.Type != queueStream {
+			problems = append(problems, FieldError{Field: prefix + ".offset", Message: "only possible for streams"})
+		} else if _, err := streamOffset(q.Offset); err != nil {
+			problems = append(problems, FieldError{Field: prefix + ".offset", Message: err.Error()})
+		}
+	}
+	return problems
+}
+
+// validate checks a single sink.
+func (s ShovelSink) validate(prefix string) []FieldError {
+	problems := s.AMQPHost.validate(prefix)
+	if s.Exchange == "" && s.Queue == "" {
+		problems = append(problems, FieldError{Field: prefix + ".exchange", Message: "required unless queue is set"})
+	}
+	if s.Exchange != "" && s.Queue != "" {
+		problems = append(problems, FieldError{Field: prefix + ".queue", Message: "cannot be combined with exchange"})
+	}
+	if s.Queue == "" && s.ExchangeType == "" {
+		problems = append(problems, FieldError{Field: prefix + ".exchangetype", Message: "required"})
+	}
+	if _, err := s.Declare.arguments(); err != nil {
+		problems = append(problems, FieldError{Field: prefix + ".declare.arguments", Message: err.Error()})
+	}
+	if s.Declare != nil && s.Declare.Exclusive && s.Queue == "" {
+		problems = append(problems, FieldError{Field: prefix + ".declare.exclusive", Message: "only possible for queues"})
+	}
+	if len(s.Bindings) > 0 && s.Queue != "" {
+		problems = append(problems, FieldError{Field: prefix + ".bindings", Message: "only possible with exchange"})
+	}
+	for i, binding := range s.Bindings {
+		if binding.Exchange == "" {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("%s.bindings[%d].exchange", prefix, i), Message: "required"})
+		}
+		if _, err := table(binding.Arguments); err != nil {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("%s.bindings[%d].arguments", prefix, i), Message: err.Error()})
+		}
+	}
+	if s.RewriteRoutingKey != nil {
+		if _, err := s.RewriteRoutingKey.compile(); err != nil {
+			problems = append(problems, FieldError{Field: prefix + ".rewriteroutingkey", Message: err.Error()})
+		}
+	}
+	if s.Match != nil {
+		if err := s.Match.check(); err != nil {
+			problems = append(problems, FieldError{Field: prefix + ".match", Message: err.Error()})
+		}
+	}
+	return problems
+}
+
+// validate checks the connection settings of a source or sink.
+func (h AMQPHost) validate(prefix string) []FieldError {
+	if h.TLS != nil {
+		if _, err := h.TLS.Config(); err != nil {
+			return []FieldError{{Field: prefix + ".tls", Message: err.Error()}}
+		}
+	}
+
+	var problems []FieldError
+	switch strings.ToUpper(h.AuthMechanism) {
+	case "PLAIN":
+	case "EXTERNAL":
+		if h.TLS == nil || h.TLS.Cert == "" {
+			problems = append(problems, FieldError{Field: prefix + ".tls.cert", Message: "required for EXTERNAL authentication"})
+		}
+	default:
+		problems = append(problems, FieldError{Field: prefix + ".authmechanism", Message: "must be PLAIN or EXTERNAL"})
+	}
+
+	checkURI := func(uri, field string) {
+		if _, err := amqp.ParseURI(uri); err != nil {
+			problems = append(problems, FieldError{Field: prefix + "." + field, Message: err.Error()})
+		}
+	}
+
+	if h.uri != "" || h.URL != "" || len(h.URLs) > 0 {
+		if h.uri != "" {
+			checkURI(h.uri, "urifile")
+		}
+		if h.URL != "" {
+			checkURI(h.URL, "uri")
+		}
+		for i, uri := range h.URLs {
+			checkURI(uri, fmt.Sprintf("uris[%d]", i))
+		}
+		return problems
+	}
+
+	if h.Host == "" {
+		problems = append(problems, FieldError{Field: prefix + ".host", Message: "required"})
+	}
+	if h.Port <= 0 || h.Port > 65535 {
+		problems = append(problems, FieldError{Field: prefix + ".port", Message: "must be between 1 and 65535"})
+	}
+	return problems
+}
+
+// uriKeys are the keys of a source or sink that take connection strings instead of hostKeys.
+var uriKeys = []string{"uri", "uris", "urifile"}
+var hostKeys = []string{"host", "port", "user", "password", "passwordfile", "vhost"}
+
+// uriConflicts reports the hostKeys set alongside a connection string in a decoded source or sink,
+// since they would be silently ignored.
+func uriConflicts(prefix string, value interface{}) []FieldError {
+	m, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	var uri bool
+	for _, key := range uriKeys {
+		uri = uri || m[key] != nil
+	}
+	if !uri {
+		return nil
+	}
+
+	var problems []FieldError
+	for _, key := range hostKeys {
+		if m[key] != nil {
+			problems = append(problems, FieldError{Field: prefix + "." + key, Message: "cannot be combined with uri, uris or urifile"})
+		}
+	}
+	return problems
+}
+
+// unknownKeys returns the paths of keys in a decoded YAML value that don't correspond to a field of t.
+func unknownKeys(path string, value interface{}, t reflect.Type) []string {
+	var unknown []string
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		fields := yamlFields(t)
+		for k, v := range m {
+			key := fmt.Sprint(k)
+			if path != "" {
+				key = path + "." + key
+			}
+			if field, ok := fields[fmt.Sprint(k)]; ok {
+				unknown = append(unknown, unknownKeys(key, v, field)...)
+			} else {
+				unknown = append(unknown, key)
+			}
+		}
+
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			unknown = append(unknown, unknownKeys(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+
+	case reflect.Ptr:
+		return unknownKeys(path, value, t.Elem())
+	}
+
+	sort.Strings(unknown)
+	return unknown
+}
+
+// typeErrors returns a problem for each value in a decoded YAML value that can't be decoded into the field
+// of t at the same path. yaml's own type errors only give line numbers, and they are those of the
+// re-encoded document rather than the user's file whenever a document is expanded or split up.
+func typeErrors(path string, value interface{}, t reflect.Type) []FieldError {
+	if value == nil {
+		return nil
+	}
+
+	var problems []FieldError
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeErrors(path, value, t.Elem())
+
+	case reflect.Interface:
+		return nil
+
+	case reflect.Struct, reflect.Map:
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			break
+		}
+		var fields map[string]reflect.Type
+		if t.Kind() == reflect.Struct {
+			fields = yamlFields(t)
+		}
+		keys := make([]string, 0, len(m))
+		values := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			keys = append(keys, fmt.Sprint(k))
+			values[fmt.Sprint(k)] = v
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			key := k
+			if path != "" {
+				key = path + "." + key
+			}
+			if fields == nil {
+				problems = append(problems, typeErrors(key, values[k], t.Elem())...)
+			} else if field, ok := fields[k]; ok {
+				problems = append(problems, typeErrors(key, values[k], field)...)
+			}
+		}
+		return problems
+
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			break
+		}
+		for i, item := range items {
+			problems = append(problems, typeErrors(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+		return problems
+	}
+
+	out, err := yaml.Marshal(value)
+	if err == nil {
+		err = yaml.Unmarshal(out, reflect.New(t).Interface())
+	}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		for _, message := range typeErr.Errors {
+			problems = append(problems, FieldError{Field: path, Message: shiftLines(message, -1)})
+		}
+	} else if err != nil {
+		problems = append(problems, FieldError{Field: path, Message: err.Error()})
+	}
+	return problems
+}
+
+// yamlLine matches the line numbers yaml puts in its errors.
+var yamlLine = regexp.MustCompile(`line (\d+): `)
+
+// shiftLines adds offset to the line numbers in a yaml error, or removes them if offset is negative.
+func shiftLines(message string, offset int) string {
+	return yamlLine.ReplaceAllStringFunc(message, func(s string) string {
+		if offset < 0 {
+			return ""
+		}
+		n, _ := strconv.Atoi(yamlLine.FindStringSubmatch(s)[1])
+		return fmt.Sprintf("line %d: ", n+offset)
+	})
+}
+
+// yamlFields returns the types of a struct's fields keyed by their YAML name, following inline fields.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+
+		inline := false
+		for _, option := range tag[1:] {
+			inline = inline || option == "inline"
+		}
+		if inline {
+			for name, fieldType := range yamlFields(field.Type) {
+				fields[name] = fieldType
+			}
+			continue
+		}
+
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
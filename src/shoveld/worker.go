@@ -2,164 +2,709 @@ package main
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
+// errStopped is returned by doShoveling once a requested shutdown has completed.
+var errStopped = errors.New("worker stopped")
+
+// errRestart is returned by doShoveling when a restart was requested.
+var errRestart = errors.New("restart requested")
+
+// drainPollInterval is how often outstanding confirms are checked while draining.
+const drainPollInterval = 50 * time.Millisecond
+
 // Worker does shoveling.
+// DrainTimeout bounds how long a stopping worker waits for outstanding publisher confirms.
 type Worker struct {
 	ShovelConfig
+	DrainTimeout     time.Duration
+	metrics          *workerMetrics
+	log              Logger
+	paused           int32         // set while the consumer should stay cancelled
+	restart          int32         // set to reconnect at the next opportunity
+	nudge            chan struct{} // signalled when paused or restart is changed
 	sourceConnection *amqp.Connection
 	sourceChannel    *amqp.Channel
-	sinkConnection   *amqp.Connection
-	sinkChannel      *amqp.Channel
+	sinks            []*workerSink
+	streams          []*streamPosition // indexed by source queue, nil unless it is a stream
 }
 
-func (w *Worker) initSource() {
-	connection, err := amqp.Dial(w.Source.URI())
+// workerSink is one of a worker's sinks and its connection.
+type workerSink struct {
+	ShovelSink
+	name       string          // for errors, sink or sinks[i] when there are several
+	transforms []transformStep // the sink's routing key rewrite followed by the shovel's transforms
+	connection *amqp.Connection
+	channel    *amqp.Channel
+}
+
+// delivery is a message consumed from one of the source's queues, identified by index.
+type delivery struct {
+	amqp.Delivery
+	queue int
+}
+
+// target is a message ready to be published to one of the worker's sinks.
+type target struct {
+	sink     int
+	exchange string
+	message  *message
+}
+
+func (w *Worker) initSource() error {
+	connection, err := w.Source.Dial()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	w.sourceConnection = connection
 
 	channel, err := connection.Channel()
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	if _, err := channel.QueueDeclare(w.Source.Queue, true, false, false, false, nil); err != nil {
-		log.Fatal(err)
+		return err
 	}
+	w.sourceChannel = channel
 
-	for _, binding := range w.Source.Bindings {
-		if binding.Exchange == "" {
-			log.Fatal("exchange missing from source binding for: ", w.Name)
+	for _, queue := range w.Source.Queues {
+		if err := queue.declare().declareQueue(channel, queue.Queue); err != nil {
+			return err
 		}
-		if err := channel.QueueBind(w.Source.Queue, binding.RoutingKey, binding.Exchange, false, nil); err != nil {
-			log.Fatal(err)
+
+		for _, binding := range queue.Bindings {
+			args, err := table(binding.Arguments)
+			if err != nil {
+				return err
+			}
+			if err := channel.QueueBind(queue.Queue, binding.RoutingKey, binding.Exchange, false, args); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
 
-	if err := channel.Qos(w.Source.Prefetch, 0, false); err != nil {
-		log.Fatal(err)
+// consumerTag returns the tag of the consumer for a source queue, which is unique on the source channel.
+func (w *Worker) consumerTag(queue int) string {
+	if len(w.Source.Queues) == 1 {
+		return w.Name
 	}
+	return w.Name + " " + w.Source.Queues[queue].Queue
+}
 
-	w.sourceConnection = connection
-	w.sourceChannel = channel
+// cancel cancels the consumer of every source queue.
+func (w *Worker) cancel(source *amqp.Channel) error {
+	for i := range w.Source.Queues {
+		if err := source.Cancel(w.consumerTag(i), false); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (w *Worker) initSink() {
-	connection, err := amqp.Dial(w.Sink.URI())
+func (w *Worker) initSink(sink *workerSink) error {
+	connection, err := sink.Dial()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	sink.connection = connection
 
 	channel, err := connection.Channel()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	sink.channel = channel
 
-	if err := channel.ExchangeDeclare(w.Sink.Exchange, w.Sink.ExchangeType, true, false, false, false, nil); err != nil {
-		log.Fatal(err)
+	if sink.Queue != "" {
+		if sink.Declare == nil {
+			return nil
+		}
+		return sink.Declare.declareQueue(channel, sink.Queue)
 	}
 
-	w.sinkConnection = connection
-	w.sinkChannel = channel
+	if err := sink.Declare.declareExchange(channel, sink.Exchange, sink.ExchangeType); err != nil {
+		return err
+	}
+	for _, binding := range sink.Bindings {
+		args, err := table(binding.Arguments)
+		if err != nil {
+			return err
+		}
+		if err := channel.ExchangeBind(binding.Exchange, binding.RoutingKey, sink.Exchange, false, args); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Init initializes the worker's source and connections, and establishes bindings.
-func (w *Worker) Init() {
-	w.initSource()
-	w.initSink()
+// On failure any partially opened connections are closed again.
+func (w *Worker) Init() error {
+	if err := w.initSource(); err != nil {
+		w.close()
+		return fmt.Errorf("source: %v", err)
+	}
+	for _, sink := range w.sinks {
+		if err := w.initSink(sink); err != nil {
+			w.close()
+			return fmt.Errorf("%s: %v", sink.name, err)
+		}
+	}
+	return nil
+}
+
+// close tears down every connection, which also closes their channels.
+func (w *Worker) close() {
+	if w.sourceConnection != nil {
+		w.sourceConnection.Close()
+	}
+	w.sourceConnection = nil
+	w.sourceChannel = nil
+	for _, sink := range w.sinks {
+		if sink.connection != nil {
+			sink.connection.Close()
+		}
+		sink.connection = nil
+		sink.channel = nil
+	}
+}
+
+// Pause cancels the worker's consumer, keeping its connections open.
+// Messages already delivered are still published and confirmed.
+func (w *Worker) Pause() {
+	atomic.StoreInt32(&w.paused, 1)
+	w.poke()
+}
+
+// Resume starts consuming again after Pause.
+func (w *Worker) Resume() {
+	atomic.StoreInt32(&w.paused, 0)
+	w.poke()
+}
+
+// Restart closes the worker's connections and reconnects immediately.
+func (w *Worker) Restart() {
+	atomic.StoreInt32(&w.restart, 1)
+	w.poke()
+}
+
+func (w *Worker) poke() {
+	select {
+	case w.nudge <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Worker) isPaused() bool {
+	return atomic.LoadInt32(&w.paused) == 1
 }
 
 // Work does the shoveling and handles reconnecting as needed.
-func (w *Worker) Work() {
-	for {
-		if w.sourceConnection == nil || w.sinkConnection == nil {
-			w.Init()
+// Failed connection attempts are retried using the shovel's reconnect backoff until stop is closed.
+func (w *Worker) Work(stop <-chan struct{}) {
+	transforms, err := compileTransforms(w.Transforms)
+	if err != nil {
+		w.log.Error("invalid transforms", "error", err)
+		return
+	}
+	w.sinks = make([]*workerSink, len(w.Sinks))
+	for i, config := range w.Sinks {
+		sink := &workerSink{ShovelSink: config, name: "sink", transforms: transforms}
+		if len(w.Sinks) > 1 {
+			sink.name = fmt.Sprintf("sinks[%d]", i)
+		}
+		if config.RewriteRoutingKey != nil {
+			rewrite, err := config.RewriteRoutingKey.compile()
+			if err != nil {
+				w.log.Error("invalid rewriteroutingkey", "sink", sink.name, "error", err)
+				return
+			}
+			sink.transforms = append([]transformStep{rewrite}, transforms...)
+		}
+		w.sinks[i] = sink
+	}
+	w.streams = make([]*streamPosition, len(w.Source.Queues))
+	for i, queue := range w.Source.Queues {
+		if queue.Type == queueStream {
+			w.streams[i] = newStreamPosition()
+		}
+	}
+
+	connected := false
+	for attempt := 0; ; attempt++ {
+		w.metrics.setState(stateConnecting)
+		if attempt > 0 {
+			delay := w.Reconnect.Delay(attempt - 1)
+			w.log.Info("reconnecting", "delay", delay)
+			select {
+			case <-stop:
+				return
+			case <-w.nudge:
+				atomic.StoreInt32(&w.restart, 0)
+			case <-time.After(delay):
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
 		}
 
-		err := w.doShoveling()
+		w.log.Debug("connecting")
+		if err := w.Init(); err != nil {
+			w.log.Warn("failed to connect", "error", err)
+			continue
+		}
+
+		if connected {
+			atomic.AddUint64(&w.metrics.reconnects, 1)
+		}
+		connected = true
+		w.log.Info("connected")
+
+		started := time.Now()
+		err := w.doShoveling(stop)
+		w.close()
+		w.metrics.setConsuming(false)
+		atomic.StoreInt64(&w.metrics.inflight, 0)
+		if err == errStopped {
+			return
+		}
+		if err == errRestart {
+			w.log.Info("restarting")
+			attempt = -1
+			continue
+		}
+		w.log.Warn("disconnected", "error", err)
+
+		// only back off further if the connection did not stay up for long
+		if time.Since(started) > w.Reconnect.MaxDelay {
+			attempt = 0
+		}
+	}
+}
+
+// watchClose reports on closed when c is notified or closed.
+func watchClose(what string, c chan *amqp.Error, closed chan<- error) {
+	go func() {
+		if err := <-c; err != nil {
+			closed <- fmt.Errorf("%s closed: %v", what, err)
+		} else {
+			closed <- fmt.Errorf("%s closed", what)
+		}
+	}()
+}
+
+// drain cancels the consumer and waits up to DrainTimeout for outstanding publishes to be confirmed,
+// and for rejected ones to be retried or dead-lettered. Deliveries still unconfirmed after that are
+// requeued on the source.
+func (w *Worker) drain(source *amqp.Channel, consuming bool, tracker *inflight, pending chan bool, closed <-chan error) error {
+	if consuming {
+		if err := w.cancel(source); err != nil {
+			return err
+		}
+	}
+
+	timeout := time.After(w.DrainTimeout)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for len(pending) > 0 {
+		select {
+		case err := <-closed:
+			return err
+		case <-timeout:
+			remaining := tracker.drain()
+			w.log.Warn("requeueing unconfirmed messages", "count", len(remaining))
+			for _, msg := range remaining {
+				msg.Nack(false, true)
+			}
+			return errStopped
+		case <-ticker.C:
+		}
+	}
+
+	return errStopped
+}
+
+// targets returns the sinks a message should be published to, each with its own copy of the message.
+// original is the message as it was consumed, which sinks' Match conditions are tested against.
+// It also reports whether any sink matched, since transforms may still have dropped every copy,
+// and fails if a sink's transforms do, in which case the message must not be published at all.
+func (w *Worker) targets(msg amqp.Delivery, original *message) ([]target, bool, error) {
+	var targets []target
+	matched := false
+	for i, sink := range w.sinks {
+		if sink.Match != nil && !sink.Match.matches(original) {
+			continue
+		}
+		matched = true
+
+		routingKey := msg.RoutingKey
+		if sink.RoutingKey != "" {
+			routingKey = sink.RoutingKey
+		}
+		out := newMessage(msg, routingKey)
+		keep, err := transform(sink.transforms, out)
 		if err != nil {
-			log.Fatal(err)
+			return nil, matched, fmt.Errorf("%s: %v", sink.name, err)
+		}
+		if keep {
+			if sink.Queue != "" {
+				// the default exchange routes by queue name
+				out.routingKey = sink.Queue
+			}
+			targets = append(targets, target{sink: i, exchange: sink.Exchange, message: out})
 		}
 
-		w.sourceConnection.Close()
-		w.sourceConnection = nil
-		w.sinkConnection.Close()
-		w.sinkConnection = nil
+		if w.SinkMode == sinkModeFirst {
+			break
+		}
 	}
+	return targets, matched, nil
 }
 
-func (w *Worker) doShoveling() error {
+// confirmSink handles the confirms of one sink's channel until it closes, passing each delivery to finish
+// once every sink has confirmed it. returns is nil unless publishing mandatory.
+func confirmSink(sink int, tracker *inflight, confirms <-chan amqp.Confirmation, returns <-chan amqp.Return, finish func(*publishing)) {
+	for {
+		var confirmed amqp.Confirmation
+		var ok bool
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+			} else {
+				tracker.returned(sink, r)
+			}
+			continue
+		case confirmed, ok = <-confirms:
+			if !ok {
+				return
+			}
+		}
+
+		// a message is always returned before it is confirmed, so its return is already waiting
+		for waiting := returns != nil; waiting; {
+			select {
+			case r, ok := <-returns:
+				if waiting = ok; ok {
+					tracker.returned(sink, r)
+				} else {
+					returns = nil
+				}
+			default:
+				waiting = false
+			}
+		}
+
+		if msg, done := tracker.confirm(sink, confirmed.DeliveryTag, confirmed.Ack); done {
+			finish(msg)
+		}
+	}
+}
+
+func (w *Worker) doShoveling(stop <-chan struct{}) error {
 	// see https://godoc.org/github.com/streadway/amqp#example-Channel-Confirm-Bridge
 
 	source := w.sourceChannel
-	sink := w.sinkChannel
 
-	shovel, err := source.Consume(w.Source.Queue, w.Name, false, false, false, false, nil)
-	if err != nil {
-		log.Panic(err)
-		return err
+	// closed receives an error as soon as any connection or channel goes away
+	closed := make(chan error, 3+2*len(w.sinks))
+	watchClose("source connection", w.sourceConnection.NotifyClose(make(chan *amqp.Error, 1)), closed)
+	watchClose("source channel", source.NotifyClose(make(chan *amqp.Error, 1)), closed)
+	for _, sink := range w.sinks {
+		watchClose(sink.name+" connection", sink.connection.NotifyClose(make(chan *amqp.Error, 1)), closed)
+		watchClose(sink.name+" channel", sink.channel.NotifyClose(make(chan *amqp.Error, 1)), closed)
 	}
 
-	// allow up to maxPending unconfirmed publishes (to avoid deadlock scenario)
+	// allow up to maxPending unconfirmed deliveries (to avoid deadlock scenario)
 	// see https://godoc.org/github.com/streadway/amqp#Channel.NotifyPublish
-	maxPending := int64(w.Source.Prefetch)
+	// each delivery is published at most once per sink, so every sink's confirms fit too
+	var maxPending int64
+	for _, queue := range w.Source.Queues {
+		maxPending += int64(queue.Prefetch)
+	}
 	pending := make(chan bool, maxPending)
-	confirms := sink.NotifyPublish(make(chan amqp.Confirmation, maxPending))
-	if err := sink.Confirm(false); err != nil {
-		log.Fatal(err)
+
+	// checked once per connection to keep the per-message cost down
+	debug := w.log.Enabled(LevelDebug)
+
+	// confirms carry sink sequence numbers, which are mapped back to source deliveries
+	tracker := newInflight(len(w.sinks))
+
+	// closed when doShoveling returns, to stop the goroutines it started
+	done := make(chan struct{})
+	defer close(done)
+
+	// failures receives rejected deliveries to retry or dead-letter, if configured,
+	// each still holding its pending slot until the source broker confirms the copy
+	var failures chan failure
+	if w.DeadLetter != nil {
+		channel, err := w.sourceConnection.Channel()
+		if err != nil {
+			return err
+		}
+		watchClose("dead-letter channel", channel.NotifyClose(make(chan *amqp.Error, 1)), closed)
+		confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+		if err := channel.Confirm(false); err != nil {
+			return err
+		}
+		failures = make(chan failure, maxPending)
+		go w.deadLetter(channel, confirms, failures, done, func() { <-pending })
 	}
 
-	// asynchronously process confirms for publishes
-	go func() {
-		for confirmed := range confirms {
-			<-pending
+	// finish acks or requeues a delivery once every sink has confirmed it
+	finish := func(msg *publishing) {
+		atomic.AddInt64(&w.metrics.inflight, -1)
+		w.metrics.observeLatency(time.Since(msg.published))
 
-			if confirmed.Ack {
-				source.Ack(confirmed.DeliveryTag, false)
-			} else {
-				source.Nack(confirmed.DeliveryTag, false, true)
+		queue := w.metrics.queues[msg.queue]
+		switch {
+		case msg.nacked:
+			atomic.AddUint64(&w.metrics.nacked, 1)
+			atomic.AddUint64(&queue.nacked, 1)
+			if debug {
+				w.log.Debug("sink nacked message", "routing_key", msg.RoutingKey, "message_id", msg.MessageId)
+			}
+			if failures != nil {
+				failures <- failure{msg, "nacked by sink", true}
+				return
+			}
+			msg.Nack(false, true)
+
+		case msg.returned != "":
+			atomic.AddUint64(&w.metrics.returned, 1)
+			w.log.Warn("sink returned message", "reason", msg.returned, "action", w.OnReturn,
+				"routing_key", msg.RoutingKey, "message_id", msg.MessageId)
+			switch w.OnReturn {
+			case returnDeadLetter:
+				atomic.AddUint64(&queue.nacked, 1)
+				failures <- failure{msg, msg.returned, false}
+				return
+			case returnDrop:
+				msg.Ack(false)
+				atomic.AddUint64(&queue.acked, 1)
+			default:
+				msg.Nack(false, true)
+				atomic.AddUint64(&queue.nacked, 1)
+			}
+
+		default:
+			msg.Ack(false)
+			atomic.AddUint64(&w.metrics.acked, 1)
+			atomic.AddUint64(&queue.acked, 1)
+		}
+		<-pending
+	}
+
+	for i, sink := range w.sinks {
+		confirms := sink.channel.NotifyPublish(make(chan amqp.Confirmation, maxPending))
+		if err := sink.channel.Confirm(false); err != nil {
+			return fmt.Errorf("%s: %v", sink.name, err)
+		}
+		var returns chan amqp.Return
+		if w.Mandatory {
+			returns = sink.channel.NotifyReturn(make(chan amqp.Return, maxPending))
+		}
+
+		// asynchronously process confirms for publishes, acking on the source once every sink has confirmed
+		go confirmSink(i, tracker, confirms, returns, finish)
+	}
+
+	// each queue's consumer is forwarded to deliveries, and reports on ended once it closes
+	deliveries := make(chan delivery)
+	ended := make(chan struct{})
+	forward := func(queue int, consumer <-chan amqp.Delivery) {
+		for msg := range consumer {
+			if stream := w.streams[queue]; stream != nil {
+				msg = stream.track(msg)
+			}
+			select {
+			case deliveries <- delivery{msg, queue}:
+			case <-done:
+				return
 			}
 		}
-	}()
+		select {
+		case ended <- struct{}{}:
+		case <-done:
+		}
+	}
+
+	// consumers is 0 while paused, and cancelling is set until they all close after pausing
+	consumers := 0
+	cancelling := false
+	reconnected := true
+	consume := func() error {
+		for i, queue := range w.Source.Queues {
+			// the prefetch limit applies to consumers started after it is set
+			if err := source.Qos(queue.Prefetch, 0, false); err != nil {
+				return err
+			}
+			consumer, err := source.Consume(queue.Queue, w.consumerTag(i), false, false, false, false, w.consumeArgs(i, reconnected))
+			if err != nil {
+				return err
+			}
+			consumers++
+			go forward(i, consumer)
+		}
+		reconnected = false
+		w.metrics.setConsuming(true)
+		w.metrics.setState(stateRunning)
+		return nil
+	}
+
+	if w.isPaused() {
+		w.metrics.setState(statePaused)
+	} else if err := consume(); err != nil {
+		return err
+	}
 
 	for {
-		msg, ok := <-shovel
-		if !ok {
-			return errors.New("source channel closed")
+		var msg amqp.Delivery
+		var queue int
+
+		select {
+		case err := <-closed:
+			return err
+		case <-stop:
+			return w.drain(source, consumers > 0 && !cancelling, tracker, pending, closed)
+		case <-w.nudge:
+			if atomic.SwapInt32(&w.restart, 0) == 1 {
+				return errRestart
+			}
+			if w.isPaused() && consumers > 0 && !cancelling {
+				w.log.Info("pausing")
+				if err := w.cancel(source); err != nil {
+					return err
+				}
+				cancelling = true
+			} else if !w.isPaused() && consumers == 0 {
+				w.log.Info("resuming")
+				if err := consume(); err != nil {
+					return err
+				}
+			}
+			continue
+		case <-ended:
+			if !cancelling {
+				return errors.New("source channel closed")
+			}
+			if consumers--; consumers > 0 {
+				continue
+			}
+			cancelling = false
+			w.metrics.setConsuming(false)
+			w.metrics.setState(statePaused)
+			if !w.isPaused() {
+				if err := consume(); err != nil {
+					return err
+				}
+			}
+			continue
+		case in := <-deliveries:
+			msg, queue = in.Delivery, in.queue
+			if w.DeadLetter != nil {
+				restoreRetried(&msg)
+			}
+		}
+		atomic.AddUint64(&w.metrics.consumed, 1)
+		atomic.AddUint64(&w.metrics.queues[queue].consumed, 1)
+		if debug {
+			w.log.Debug("received message",
+				"queue", w.Source.Queues[queue].Queue,
+				"exchange", msg.Exchange,
+				"routing_key", msg.RoutingKey,
+				"message_id", msg.MessageId,
+				"redelivered", msg.Redelivered)
 		}
 
-		routingKey := msg.RoutingKey
-		if w.Sink.RoutingKey != "" {
-			routingKey = w.Sink.RoutingKey
-		}
-
-		// block until there's guaranteed to be room on confirms channel
-		pending <- true
-
-		err := sink.Publish(w.Sink.Exchange, routingKey, false, false, amqp.Publishing{
-			ContentType:     msg.ContentType,
-			ContentEncoding: msg.ContentEncoding,
-			DeliveryMode:    msg.DeliveryMode,
-			Priority:        msg.Priority,
-			CorrelationId:   msg.CorrelationId,
-			ReplyTo:         msg.ReplyTo,
-			Expiration:      msg.Expiration,
-			MessageId:       msg.MessageId,
-			Timestamp:       msg.Timestamp,
-			Type:            msg.Type,
-			UserId:          msg.UserId,
-			AppId:           msg.AppId,
-			Headers:         msg.Headers,
-			Body:            msg.Body})
+		original := newMessage(msg, msg.RoutingKey)
+		var targets []target
+		if w.Filter != nil && !w.Filter.Match.matches(original) {
+			atomic.AddUint64(&w.metrics.filtered, 1)
+			if debug {
+				w.log.Debug("filtered message", "routing_key", msg.RoutingKey, "message_id", msg.MessageId, "action", w.Filter.Otherwise)
+			}
 
-		if err != nil {
-			<-pending
+			switch w.Filter.Otherwise {
+			case filterRequeue:
+				msg.Nack(false, true)
+				continue
+			case filterRoute:
+				// routed messages go to the first sink's broker and skip the transforms, which are meant for the sinks
+				if w.Filter.Route.RoutingKey != "" {
+					original.routingKey = w.Filter.Route.RoutingKey
+				}
+				targets = []target{{sink: 0, exchange: w.Filter.Route.Exchange, message: original}}
+			default:
+				msg.Ack(false)
+				continue
+			}
+		} else {
+			var matched bool
+			var err error
+			if targets, matched, err = w.targets(msg, original); err != nil {
+				// the message is rejected rather than published somewhere it wasn't meant to go
+				atomic.AddUint64(&w.metrics.failed, 1)
+				w.log.Warn("failed to transform message", "error", err, "routing_key", msg.RoutingKey, "message_id", msg.MessageId)
+				if failures == nil {
+					msg.Nack(false, false)
+					continue
+				}
+				select {
+				case err := <-closed:
+					return err
+				case <-stop:
+					msg.Nack(false, true)
+					return w.drain(source, consumers > 0 && !cancelling, tracker, pending, closed)
+				case pending <- true:
+				}
+				failures <- failure{&publishing{Delivery: msg, queue: queue}, "transform failed: " + err.Error(), false}
+				continue
+			}
+			if len(targets) == 0 {
+				msg.Ack(false)
+				atomic.AddUint64(&w.metrics.dropped, 1)
+				if debug {
+					w.log.Debug("dropped message", "routing_key", msg.RoutingKey, "message_id", msg.MessageId, "matched_sink", matched)
+				}
+				continue
+			}
+		}
+
+		// block until there's guaranteed to be room on confirms channels
+		select {
+		case err := <-closed:
+			return err
+		case <-stop:
 			msg.Nack(false, true)
-			log.Panic(err)
+			return w.drain(source, consumers > 0 && !cancelling, tracker, pending, closed)
+		case pending <- true:
+		}
+
+		published := tracker.add(msg, queue, targets)
+		atomic.AddInt64(&w.metrics.inflight, 1)
+
+		for i, t := range targets {
+			sink := w.sinks[t.sink]
+			if err := sink.channel.Publish(t.exchange, t.message.routingKey, w.Mandatory, false, t.message.Publishing); err != nil {
+				tracker.remove(published, i)
+				atomic.AddInt64(&w.metrics.inflight, -1)
+				<-pending
+				msg.Nack(false, true)
+				return fmt.Errorf("%s: %v", sink.name, err)
+			}
+
+			atomic.AddUint64(&w.metrics.published, 1)
+			if msg.Redelivered {
+				atomic.AddUint64(&w.metrics.republished, 1)
+			}
 		}
 	}
 }
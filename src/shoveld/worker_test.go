@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeChannel stands in for a source channel, recording how each delivery tag was settled.
+// Tags restart at 1 on every channel, as they do on the broker.
+type fakeChannel struct {
+	t       *testing.T
+	name    string
+	m       sync.Mutex
+	tag     uint64
+	settled map[uint64]string
+}
+
+func newFakeChannel(t *testing.T, name string) *fakeChannel {
+	return &fakeChannel{t: t, name: name, settled: map[uint64]string{}}
+}
+
+// deliver returns the channel's next delivery, identified by id.
+func (c *fakeChannel) deliver(id string) amqp.Delivery {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.tag++
+	return amqp.Delivery{Acknowledger: c, DeliveryTag: c.tag, MessageId: id, Body: []byte(id)}
+}
+
+func (c *fakeChannel) settle(tag uint64, multiple bool, how string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	switch {
+	case multiple:
+		c.t.Errorf("%s: tag %d settled with multiple", c.name, tag)
+	case tag == 0 || tag > c.tag:
+		c.t.Errorf("%s: %s of tag %d, which was never delivered on this channel", c.name, how, tag)
+	case c.settled[tag] != "":
+		c.t.Errorf("%s: %s of tag %d, already settled with %s", c.name, how, tag, c.settled[tag])
+	}
+	c.settled[tag] = how
+	return nil
+}
+
+func (c *fakeChannel) Ack(tag uint64, multiple bool) error {
+	return c.settle(tag, multiple, "ack")
+}
+
+func (c *fakeChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		return c.settle(tag, multiple, "requeue")
+	}
+	return c.settle(tag, multiple, "nack")
+}
+
+func (c *fakeChannel) Reject(tag uint64, requeue bool) error {
+	return c.Nack(tag, false, requeue)
+}
+
+// expect checks how every tag delivered on the channel has been settled so far.
+func (c *fakeChannel) expect(want map[uint64]string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for tag := uint64(1); tag <= c.tag; tag++ {
+		if c.settled[tag] != want[tag] {
+			c.t.Errorf("%s: tag %d settled with %q, want %q", c.name, tag, c.settled[tag], want[tag])
+		}
+	}
+}
+
+// fakeSinks stands in for the confirming channels of a worker's sinks. Like the library,
+// it numbers publishes from 1 on each channel and delivers confirms to a NotifyPublish channel.
+type fakeSinks struct {
+	tracker   *inflight
+	published []uint64
+	confirms  []chan amqp.Confirmation
+	finished  chan *publishing
+	stopped   sync.WaitGroup
+}
+
+// openSinks opens a fresh set of sink channels, running confirmSink for each of them as doShoveling does.
+// Finished deliveries are acked, or requeued if nacked.
+func openSinks(sinks int) *fakeSinks {
+	s := &fakeSinks{
+		tracker:   newInflight(sinks),
+		published: make([]uint64, sinks),
+		confirms:  make([]chan amqp.Confirmation, sinks),
+		finished:  make(chan *publishing, 100)}
+	finish := func(p *publishing) {
+		if p.nacked {
+			p.Nack(false, true)
+		} else {
+			p.Ack(false)
+		}
+		s.finished <- p
+	}
+	for i := range s.confirms {
+		s.confirms[i] = make(chan amqp.Confirmation, 100)
+		s.stopped.Add(1)
+		go func(i int) {
+			confirmSink(i, s.tracker, s.confirms[i], nil, finish)
+			s.stopped.Done()
+		}(i)
+	}
+	return s
+}
+
+// publish tracks msg and publishes it to each of the given sinks, returning the sequence number used on each.
+func (s *fakeSinks) publish(msg amqp.Delivery, sinks ...int) map[int]uint64 {
+	targets := make([]target, len(sinks))
+	for i, sink := range sinks {
+		targets[i] = target{sink: sink, exchange: "out", message: newMessage(msg, msg.RoutingKey)}
+	}
+	s.tracker.add(msg, 0, targets)
+
+	seqs := make(map[int]uint64, len(sinks))
+	for _, sink := range sinks {
+		s.published[sink]++
+		seqs[sink] = s.published[sink]
+	}
+	return seqs
+}
+
+func (s *fakeSinks) confirm(sink int, tag uint64, ack bool) {
+	s.confirms[sink] <- amqp.Confirmation{DeliveryTag: tag, Ack: ack}
+}
+
+// wait waits for the given deliveries to finish, in any order.
+func (s *fakeSinks) wait(t *testing.T, ids ...string) {
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	for range ids {
+		select {
+		case p := <-s.finished:
+			if !want[p.MessageId] {
+				t.Fatalf("finished %s, want one of %v", p.MessageId, ids)
+			}
+			delete(want, p.MessageId)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+}
+
+// close closes the sink channels, requeueing whatever is still unconfirmed as doShoveling does on reconnect.
+func (s *fakeSinks) close() {
+	for _, c := range s.confirms {
+		close(c)
+	}
+	s.stopped.Wait()
+	for _, p := range s.tracker.drain() {
+		p.Nack(false, true)
+	}
+}
+
+func TestConfirmsAcrossChannelRestarts(t *testing.T) {
+	first := newFakeChannel(t, "first source channel")
+	sinks := openSinks(2)
+
+	a := sinks.publish(first.deliver("a"), 0, 1)
+	b := sinks.publish(first.deliver("b"), 1)
+	c := sinks.publish(first.deliver("c"), 0, 1)
+	d := sinks.publish(first.deliver("d"), 0)
+
+	// sequence numbers are per sink, so 2 is b on sink 1 but c on sink 0
+	sinks.confirm(1, c[1], true)
+	sinks.confirm(0, c[0], false)
+	sinks.confirm(1, b[1], true)
+	sinks.confirm(0, d[0], true)
+	sinks.confirm(0, a[0], true)
+	sinks.wait(t, "b", "c", "d")
+	first.expect(map[uint64]string{2: "ack", 3: "requeue", 4: "ack"})
+
+	// the source channel is reopened while a is still unconfirmed, and its tags restart at 1
+	second := newFakeChannel(t, "second source channel")
+	e := sinks.publish(second.deliver("e"), 0, 1)
+	sinks.confirm(0, e[0], true)
+	sinks.confirm(1, e[1], true)
+	sinks.wait(t, "e")
+	second.expect(map[uint64]string{1: "ack"})
+	first.expect(map[uint64]string{2: "ack", 3: "requeue", 4: "ack"})
+
+	sinks.confirm(1, a[1], true)
+	sinks.wait(t, "a")
+	first.expect(map[uint64]string{1: "ack", 2: "ack", 3: "requeue", 4: "ack"})
+
+	// f is requeued when the sink channels close before confirming it
+	f := sinks.publish(second.deliver("f"), 0, 1)
+	sinks.confirm(0, f[0], true)
+	sinks.close()
+	second.expect(map[uint64]string{1: "ack", 2: "requeue"})
+
+	// after reconnecting, every channel is new and numbering starts again on both sides
+	third := newFakeChannel(t, "third source channel")
+	sinks = openSinks(2)
+	g := sinks.publish(third.deliver("g"), 0, 1)
+	h := sinks.publish(third.deliver("h"), 1)
+	if g[0] != 1 || g[1] != 1 || h[1] != 2 {
+		t.Fatalf("sequence numbers after reconnecting: g = %v, h = %v", g, h)
+	}
+	sinks.confirm(1, h[1], false)
+	sinks.confirm(1, g[1], true)
+	sinks.confirm(0, g[0], true)
+	sinks.wait(t, "g", "h")
+	third.expect(map[uint64]string{1: "ack", 2: "requeue"})
+
+	// nothing on the earlier channels was settled again
+	first.expect(map[uint64]string{1: "ack", 2: "ack", 3: "requeue", 4: "ack"})
+	second.expect(map[uint64]string{1: "ack", 2: "requeue"})
+	sinks.close()
+}
+
+func TestConfirmsAfterFailedPublish(t *testing.T) {
+	source := newFakeChannel(t, "source channel")
+	sinks := openSinks(2)
+
+	sinks.publish(source.deliver("a"), 0, 1)
+
+	// b reaches sink 0, but publishing it to sink 1 fails, so it is requeued straight away
+	msg := source.deliver("b")
+	p := sinks.tracker.add(msg, 0, []target{
+		{sink: 0, exchange: "out", message: newMessage(msg, "")},
+		{sink: 1, exchange: "out", message: newMessage(msg, "")}})
+	sinks.published[0]++
+	sinks.tracker.remove(p, 1)
+	msg.Nack(false, true)
+
+	// sink 0 still confirms b's publish, which must not settle anything
+	c := sinks.publish(source.deliver("c"), 0, 1)
+	if c[0] != 3 || c[1] != 2 {
+		t.Fatalf("c published as %v, want sink 0 seq 3 and sink 1 seq 2", c)
+	}
+	for sink := 0; sink < 2; sink++ {
+		for tag := uint64(1); tag <= sinks.published[sink]; tag++ {
+			sinks.confirm(sink, tag, true)
+		}
+	}
+	sinks.wait(t, "a", "c")
+	source.expect(map[uint64]string{1: "ack", 2: "requeue", 3: "ack"})
+
+	sinks.close()
+	source.expect(map[uint64]string{1: "ack", 2: "requeue", 3: "ack"})
+}
+
+func TestConfirmsWithReturns(t *testing.T) {
+	source := newFakeChannel(t, "source channel")
+	tracker := newInflight(1)
+	confirms := make(chan amqp.Confirmation, 10)
+	returns := make(chan amqp.Return, 10)
+	finished := make(chan *publishing, 10)
+	go confirmSink(0, tracker, confirms, returns, func(p *publishing) { finished <- p })
+	defer close(confirms)
+
+	for _, id := range []string{"a", "b", "a"} {
+		msg := source.deliver(id)
+		tracker.add(msg, 0, []target{{sink: 0, exchange: "out", message: newMessage(msg, "key")}})
+	}
+
+	// one of the a's is unroutable, and the broker returns it before confirming it
+	returns <- amqp.Return{Exchange: "out", RoutingKey: "key", MessageId: "a", Body: []byte("a"), ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	for tag := uint64(1); tag <= 3; tag++ {
+		confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+	}
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		select {
+		case p := <-finished:
+			got = append(got, fmt.Sprintf("%d %q", p.DeliveryTag, p.returned))
+		case <-time.After(time.Second):
+			t.Fatalf("timed out, finished %v", got)
+		}
+	}
+	// identical messages are interchangeable, so the oldest unconfirmed one is taken as returned
+	want := []string{`1 "returned by exchange out: 312 NO_ROUTE"`, `2 ""`, `3 ""`}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("finished %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+// multipleConfirm is a basic.ack or basic.nack with multiple set, sent once after publishes have been received.
+type multipleConfirm struct {
+	after int
+	tag   uint64
+	ack   bool
+}
+
+// amqpFrame is a frame read from the client, without its frame-end octet.
+type amqpFrame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+func readFrame(r io.Reader) (amqpFrame, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return amqpFrame{}, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return amqpFrame{}, err
+	}
+	return amqpFrame{header[0], binary.BigEndian.Uint16(header[1:]), payload[:len(payload)-1]}, nil
+}
+
+// method returns the class and method IDs of a method frame.
+func (f amqpFrame) method() [2]uint16 {
+	if f.kind != 1 || len(f.payload) < 4 {
+		return [2]uint16{}
+	}
+	return [2]uint16{binary.BigEndian.Uint16(f.payload), binary.BigEndian.Uint16(f.payload[2:])}
+}
+
+func writeMethod(w io.Writer, channel, class, method uint16, args ...byte) error {
+	frame := make([]byte, 11, 12+len(args))
+	frame[0] = 1
+	binary.BigEndian.PutUint16(frame[1:], channel)
+	binary.BigEndian.PutUint32(frame[3:], uint32(4+len(args)))
+	binary.BigEndian.PutUint16(frame[7:], class)
+	binary.BigEndian.PutUint16(frame[9:], method)
+	frame = append(append(frame, args...), 0xCE)
+	_, err := w.Write(frame)
+	return err
+}
+
+// serveConfirms plays a broker that lets the client open a confirming channel and confirms its publishes
+// with nothing but the given multiple confirms, until the client closes the connection.
+func serveConfirms(conn net.Conn, confirms []multipleConfirm) error {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	var start bytes.Buffer
+	start.Write([]byte{0, 9, 0, 0, 0, 0})
+	writeLongString(&start, "PLAIN")
+	writeLongString(&start, "en_US")
+	if err := writeMethod(conn, 0, 10, 10, start.Bytes()...); err != nil {
+		return err
+	}
+
+	published := 0
+	for {
+		f, err := readFrame(conn)
+		if err != nil {
+			return err
+		}
+		switch f.method() {
+		case [2]uint16{10, 11}: // connection.start-ok: tune with 128kB frames and no heartbeats
+			err = writeMethod(conn, 0, 10, 30, 0, 0, 0, 2, 0, 0, 0, 0)
+		case [2]uint16{10, 40}: // connection.open
+			err = writeMethod(conn, 0, 10, 41, 0)
+		case [2]uint16{20, 10}: // channel.open
+			err = writeMethod(conn, f.channel, 20, 11, 0, 0, 0, 0)
+		case [2]uint16{85, 10}: // confirm.select
+			err = writeMethod(conn, f.channel, 85, 11)
+		case [2]uint16{60, 40}: // basic.publish, followed by a header frame and a body frame
+			published++
+			for _, c := range confirms {
+				if c.after != published {
+					continue
+				}
+				args := make([]byte, 9)
+				binary.BigEndian.PutUint64(args, c.tag)
+				args[8] = 1
+				if c.ack {
+					err = writeMethod(conn, f.channel, 60, 80, args...)
+				} else {
+					err = writeMethod(conn, f.channel, 60, 120, args...)
+				}
+			}
+		case [2]uint16{10, 50}: // connection.close
+			return writeMethod(conn, 0, 10, 51)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestConfirmsWithMultiple(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	served := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		defer conn.Close()
+		served <- serveConfirms(conn, []multipleConfirm{{after: 2, tag: 2, ack: true}, {after: 3, tag: 3, ack: false}})
+	}()
+
+	conn, err := amqp.Dial(fmt.Sprintf("amqp://guest:guest@%s/", listener.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the library splits multiple confirms into one per sequence number before they reach confirmSink
+	source := newFakeChannel(t, "source channel")
+	tracker := newInflight(1)
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 10))
+	finished := make(chan *publishing, 10)
+	stopped := make(chan struct{})
+	go func() {
+		confirmSink(0, tracker, confirms, nil, func(p *publishing) {
+			if p.nacked {
+				p.Nack(false, true)
+			} else {
+				p.Ack(false)
+			}
+			finished <- p
+		})
+		close(stopped)
+	}()
+
+	for _, id := range []string{"a", "b", "c"} {
+		msg := source.deliver(id)
+		tracker.add(msg, 0, []target{{sink: 0, exchange: "out", message: newMessage(msg, "key")}})
+		if err := channel.Publish("out", "key", false, false, amqp.Publishing{MessageId: id, Body: msg.Body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d deliveries finished", i)
+		}
+	}
+	source.expect(map[uint64]string{1: "ack", 2: "ack", 3: "requeue"})
+
+	if err := conn.Close(); err != nil {
+		t.Error(err)
+	}
+	<-stopped
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+}